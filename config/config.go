@@ -0,0 +1,238 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	dbconfig "github.com/lakstap/go-atk/database/config"
+	"github.com/lakstap/go-atk/secrets"
+)
+
+// ATKConfig is the configuration of an ATK gateway or service
+type ATKConfig struct {
+	// Environment the application is running in, e.g. "dev" or "prod"
+	Environment string `json:"environment"`
+
+	Gateway  GatewayConfig     `json:"gateway"`
+	Auth     AuthConfig        `json:"auth"`
+	Backends []BackendConfig   `json:"backends"`
+	Database dbconfig.DBConfig `json:"database"`
+	Cache    CacheConfig       `json:"cache"`
+	Logging  LoggingConfig     `json:"logging"`
+
+	// Databases are the named databases of the services besides the default one,
+	// see atk.ATKGrpcService.DB
+	Databases map[string]dbconfig.DBConfig `json:"databases"`
+
+	// Services holds the config sections of the service types by type name,
+	// see atk.ATKGrpcService.ConfigSection
+	Services map[string]json.RawMessage `json:"services"`
+}
+
+// GatewayConfig configures the HTTP server of the gateway
+type GatewayConfig struct {
+	// Addr is the address to listen
+	Addr string `json:"addr"`
+
+	// AdminAddr is the private address serving /debug/vars, off when empty
+	AdminAddr string `json:"adminAddr"`
+
+	// Endpoints are the static backend addresses, by endpoint handler index
+	Endpoints []string `json:"endpoints"`
+
+	// Network is one of "tcp" or "unix"
+	Network string `json:"network"`
+
+	// SwaggerDir is the directory containing the swagger definitions
+	SwaggerDir string `json:"swaggerDir"`
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when set
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+
+	// BackendTLS dials the backends over TLS, unless they have their own settings
+	BackendTLS *TLSConfig `json:"backendTls"`
+
+	// CORS lists the cross origin requests allowed, every origin when empty
+	CORS CORSConfig `json:"cors"`
+
+	// TrustedProxyHops is the number of proxies in front of the gateway whose
+	// X-Forwarded-For / X-Real-IP are trusted, 0 takes the connection address
+	TrustedProxyHops int `json:"trustedProxyHops"`
+
+	// RateLimit limits the requests per user, API key or client IP, off without limits
+	RateLimit RateLimitConfig `json:"rateLimit"`
+}
+
+// RateLimitConfig configures the rate limits of the gateway
+type RateLimitConfig struct {
+	// Default applies to every route without a more specific limit
+	Default RateLimit `json:"default"`
+
+	// Routes maps an URL path prefix to its limit, the longest prefix wins
+	Routes map[string]RateLimit `json:"routes"`
+
+	// Store is "memory", local to each replica, or "mongo", shared by the replicas
+	// through the collection StoreCollection of the default database
+	Store           string `json:"store"`
+	StoreCollection string `json:"storeCollection"`
+}
+
+// RateLimit is a token bucket holding up to Burst requests, refilled with
+// Requests tokens every Period
+type RateLimit struct {
+	Requests int      `json:"requests"`
+	Period   Duration `json:"period"`
+	Burst    int      `json:"burst"`
+}
+
+// Enabled reports whether any limit is set.
+func (c RateLimitConfig) Enabled() bool {
+	return c.Default.Requests > 0 || len(c.Routes) > 0
+}
+
+// TLSConfig configures a TLS client connection
+type TLSConfig struct {
+	CAFile             string `json:"caFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// CORSConfig configures the cross origin resource sharing of the gateway
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+}
+
+// AuthConfig configures the bearer token verification of the gateway
+type AuthConfig struct {
+	Enabled            bool           `json:"enabled"`
+	IssuerURL          string         `json:"issuerUrl"`
+	ClientID           secrets.Secret `json:"clientId"`
+	Paths              []string       `json:"paths"`
+	InsecureSkipVerify bool           `json:"insecureSkipVerify"`
+
+	// EventStreamTokenParam is the query parameter holding the token of the
+	// Server-Sent Events requests of the browsers, off when empty
+	EventStreamTokenParam string `json:"eventStreamTokenParam"`
+}
+
+// BackendConfig configures the connections to a backend registered
+// in the gateway under its micro service name
+type BackendConfig struct {
+	Service        string   `json:"service"`
+	Addresses      []string `json:"addresses"`
+	Balancer       string   `json:"balancer"`
+	SubConns       int      `json:"subConns"`
+	MaxRecvMsgSize int      `json:"maxRecvMsgSize"`
+	MaxSendMsgSize int      `json:"maxSendMsgSize"`
+
+	// TLS dials the backend over TLS, overriding gateway.backendTls
+	TLS *TLSConfig `json:"tls"`
+}
+
+// CacheConfig configures the in-memory cache of a service
+type CacheConfig struct {
+	DefaultExpiration Duration `json:"defaultExpiration"`
+	CleanupInterval   Duration `json:"cleanupInterval"`
+}
+
+// LoggingConfig configures the logs
+type LoggingConfig struct {
+	// Level is the lowest level written to stderr, one of "info", "warning" or "error"
+	Level string `json:"level"`
+
+	// ToStderr writes the logs to stderr instead of files
+	ToStderr bool `json:"toStderr"`
+}
+
+// Default returns the configuration used for the values not set by any source.
+func Default() *ATKConfig {
+	return &ATKConfig{
+		Environment: "dev",
+		Gateway: GatewayConfig{
+			Addr:       ":8090",
+			Network:    "tcp",
+			SwaggerDir: "proto/api",
+			RateLimit: RateLimitConfig{
+				Store:           "memory",
+				StoreCollection: "ratelimits",
+			},
+		},
+		Cache: CacheConfig{
+			DefaultExpiration: Duration(5 * time.Minute),
+			CleanupInterval:   Duration(10 * time.Minute),
+		},
+		Logging: LoggingConfig{
+			Level: "info",
+		},
+	}
+}
+
+// Duration is a time.Duration read from a string such as "30s" or a number of nanoseconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(time.Duration(v))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(data))
+	}
+	return nil
+}
+
+// ResolveSecrets reads the secrets the configuration refers to.
+func (c *ATKConfig) ResolveSecrets() error {
+	var errs ValidationError
+	if err := c.Auth.ClientID.Resolve(); err != nil {
+		errs = append(errs, FieldError{Field: "auth.clientId", Message: err.Error()})
+	}
+	if err := c.Database.ResolveSecrets(); err != nil {
+		errs = append(errs, FieldError{Field: "database", Message: err.Error()})
+	}
+	for _, name := range c.databaseNames() {
+		db := c.Databases[name]
+		if err := db.ResolveSecrets(); err != nil {
+			errs = append(errs, FieldError{Field: "databases." + name, Message: err.Error()})
+		}
+		c.Databases[name] = db
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// databaseNames returns the names of the named databases, sorted.
+func (c *ATKConfig) databaseNames() []string {
+	names := make([]string, 0, len(c.Databases))
+	for name := range c.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Dump returns the configuration as indented JSON, with the secrets redacted.
+func (c *ATKConfig) Dump() ([]byte, error) {
+	return json.MarshalIndent(c, "", "  ")
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/micro/go-config"
+	"github.com/micro/go-config/source"
+	"github.com/micro/go-config/source/env"
+	"github.com/micro/go-config/source/file"
+	"github.com/micro/go-config/source/memory"
+)
+
+// flagAliases maps the legacy gateway flags onto the configuration keys
+var flagAliases = map[string]string{
+	"port":        "gateway.addr",
+	"endpoint":    "gateway.endpoints",
+	"network":     "gateway.network",
+	"environment": "environment",
+	"swagger_dir": "gateway.swaggerDir",
+}
+
+type loadOptions struct {
+	profile   string
+	files     []string
+	envPrefix string
+	flags     *flag.FlagSet
+}
+
+// LoadOption adds a source to the configuration
+type LoadOption func(*loadOptions)
+
+// WithFile reads a JSON or YAML file, the format is taken from the extension.
+// Later files override the earlier ones.
+func WithFile(path string) LoadOption {
+	return func(o *loadOptions) {
+		o.files = append(o.files, path)
+	}
+}
+
+// WithEnv reads the environment variables starting with the prefix,
+// e.g. ATK_GATEWAY_ADDR for "gateway.addr" with the prefix "ATK".
+func WithEnv(prefix string) LoadOption {
+	return func(o *loadOptions) {
+		o.envPrefix = prefix
+	}
+}
+
+// WithFlags reads the flags set on the command line, named after the
+// configuration keys, e.g. -gateway.addr=:8080, or after the legacy gateway flags.
+func WithFlags(fs *flag.FlagSet) LoadOption {
+	return func(o *loadOptions) {
+		o.flags = fs
+	}
+}
+
+// Load reads and validates the configuration. The sources take precedence
+// in the order defaults, files, environment variables, flags.
+// A production configuration must also pass CheckProduction.
+func Load(opts ...LoadOption) (*ATKConfig, error) {
+	options := loadOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var sources []source.Source
+	for _, path := range options.files {
+		sources = append(sources, file.NewSource(file.WithPath(path)))
+	}
+	if options.envPrefix != "" {
+		sources = append(sources, typedSource{env.NewSource(env.WithStrippedPrefix(options.envPrefix))})
+	}
+	if options.flags != nil {
+		data, err := flagValues(options.flags)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, memory.NewSource(memory.WithData(data)))
+	}
+
+	cfg := Default()
+	if options.profile != "" {
+		cfg.Environment = options.profile
+	}
+	if len(sources) > 0 {
+		c := config.NewConfig()
+		if err := c.Load(sources...); err != nil {
+			return nil, err
+		}
+		if err := c.Scan(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.ResolveSecrets(); err != nil {
+		return nil, err
+	}
+	if cfg.IsProduction() {
+		if err := cfg.CheckProduction(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// flagValues returns the flags set on the command line as a JSON document,
+// keeping the type of the flags which have one, e.g. -auth.enabled=true.
+func flagValues(fs *flag.FlagSet) ([]byte, error) {
+	values := make(map[string]interface{})
+	fs.Visit(func(f *flag.Flag) {
+		key := f.Name
+		if alias, ok := flagAliases[key]; ok {
+			key = alias
+		}
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		setPath(values, strings.Split(key, "."), value)
+	})
+	return json.Marshal(typedValue(values, configType))
+}
+
+var (
+	configType      = reflect.TypeOf(ATKConfig{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// typedSource converts the values of the environment variables, which are strings,
+// numbers or booleans, to the types of the configuration fields they are read into,
+// e.g. ATK_GATEWAY_ENDPOINTS=a:9090,b:9090 into a list.
+type typedSource struct {
+	source.Source
+}
+
+func (s typedSource) Read() (*source.ChangeSet, error) {
+	cs, err := s.Source.Read()
+	if err != nil {
+		return nil, err
+	}
+	var values interface{}
+	decoder := json.NewDecoder(bytes.NewReader(cs.Data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("config: failed to read the %s source: %v", s.String(), err)
+	}
+	data, err := json.Marshal(typedValue(values, configType))
+	if err != nil {
+		return nil, err
+	}
+	typed := *cs
+	typed.Data = data
+	typed.Checksum = typed.Sum()
+	return &typed, nil
+}
+
+// typedValue converts a value to the type it is read into: the strings of the list fields
+// are split on commas, and the scalars of the string fields and of the types reading
+// themselves from a string, e.g. secrets, are turned into strings.
+func typedValue(value interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		if t.Kind() == reflect.Struct {
+			return scalarString(value)
+		}
+		return value
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return scalarString(value)
+	case reflect.Slice:
+		if list, ok := value.(string); ok && t.Elem().Kind() == reflect.String {
+			items := []interface{}{}
+			for _, item := range strings.Split(list, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			return items
+		}
+		if items, ok := value.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = typedValue(item, t.Elem())
+			}
+		}
+	case reflect.Map:
+		if values, ok := value.(map[string]interface{}); ok {
+			for key, item := range values {
+				values[key] = typedValue(item, t.Elem())
+			}
+		}
+	case reflect.Struct:
+		if values, ok := value.(map[string]interface{}); ok {
+			for key, item := range values {
+				if field, ok := jsonField(t, key); ok {
+					values[key] = typedValue(item, field.Type)
+				}
+			}
+		}
+	}
+	return value
+}
+
+// scalarString returns the numbers and booleans as strings, the other values as they are.
+func scalarString(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}, string, nil:
+		return value
+	case json.Number:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// jsonField finds the struct field of a key, matching its json name case-insensitively
+// as encoding/json does, e.g. "swaggerdir" of an environment variable.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func setPath(values map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			values[key] = next
+		}
+		values = next
+	}
+	values[path[len(path)-1]] = value
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// profileExtensions are tried in order for every config file of a profile
+var profileExtensions = []string{".yaml", ".yml", ".json"}
+
+// WithProfile reads the base config file of the directory (config.yaml) and
+// overlays the file of the environment (config.<env>.yaml) when it exists.
+// Maps are merged key by key, lists and scalar values of the overlay replace the base ones.
+// An empty env is taken from the ATK_ENVIRONMENT variable, "dev" by default.
+func WithProfile(dir, env string) LoadOption {
+	return func(o *loadOptions) {
+		if env == "" {
+			env = ProfileFromEnv()
+		}
+		if base, ok := findConfigFile(dir, "config"); ok {
+			o.files = append(o.files, base)
+		}
+		if overlay, ok := findConfigFile(dir, "config."+env); ok {
+			o.files = append(o.files, overlay)
+		}
+		o.profile = env
+	}
+}
+
+// ProfileFromEnv returns the environment selected by ATK_ENVIRONMENT, "dev" by default.
+func ProfileFromEnv() string {
+	if env := os.Getenv("ATK_ENVIRONMENT"); env != "" {
+		return env
+	}
+	return "dev"
+}
+
+// IsProduction reports whether the configuration is for a production environment.
+func (c *ATKConfig) IsProduction() bool {
+	switch strings.ToLower(c.Environment) {
+	case "prod", "production":
+		return true
+	}
+	return false
+}
+
+func findConfigFile(dir, name string) (string, bool) {
+	for _, ext := range profileExtensions {
+		path := filepath.Join(dir, name+ext)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+)
+
+// CheckProduction refuses the settings which are insecure in production:
+// plaintext backends, skipped TLS verification, wildcard CORS and disabled auth.
+func (c *ATKConfig) CheckProduction() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if !c.Auth.Enabled {
+		add("auth.enabled", "auth must be enabled in production")
+	}
+	if c.Auth.InsecureSkipVerify {
+		add("auth.insecureSkipVerify", "the issuer TLS certificate must be verified in production")
+	}
+
+	if len(c.Gateway.CORS.AllowedOrigins) == 0 {
+		add("gateway.cors.allowedOrigins", "the allowed origins must be listed in production")
+	}
+	for i, origin := range c.Gateway.CORS.AllowedOrigins {
+		if origin == "*" {
+			add(fmt.Sprintf("gateway.cors.allowedOrigins[%d]", i), "wildcard origins are not allowed in production")
+		}
+	}
+
+	if c.Gateway.BackendTLS == nil && len(c.Gateway.Endpoints) > 0 {
+		add("gateway.backendTls", "the static endpoints must be dialed over TLS in production")
+	}
+	if c.Gateway.BackendTLS != nil && c.Gateway.BackendTLS.InsecureSkipVerify {
+		add("gateway.backendTls.insecureSkipVerify", "the backend TLS certificates must be verified in production")
+	}
+	for i, backend := range c.Backends {
+		field := fmt.Sprintf("backends[%d].tls", i)
+		tls := backend.TLS
+		if tls == nil {
+			tls = c.Gateway.BackendTLS
+		}
+		if tls == nil {
+			add(field, "backend %s must be dialed over TLS in production", backend.Service)
+		} else if tls.InsecureSkipVerify {
+			add(field+".insecureSkipVerify", "the backend TLS certificates must be verified in production")
+		}
+	}
+
+	if c.Database.TLS != nil && c.Database.TLS.InsecureSkipVerify {
+		add("database.tls.insecureSkipVerify", "the database TLS certificates must be verified in production")
+	}
+	for _, name := range c.databaseNames() {
+		if tls := c.Databases[name].TLS; tls != nil && tls.InsecureSkipVerify {
+			add("databases."+name+".tls.insecureSkipVerify", "the database TLS certificates must be verified in production")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	dbconfig "github.com/lakstap/go-atk/database/config"
+)
+
+// FieldError describes an invalid configuration value
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every invalid value of a configuration
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		messages = append(messages, fieldErr.Error())
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// Validate checks the configuration and returns a ValidationError
+// listing every invalid field.
+func (c *ATKConfig) Validate() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Gateway.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Gateway.Addr); err != nil {
+			add("gateway.addr", "must be host:port, got %q", c.Gateway.Addr)
+		}
+	}
+	if c.Gateway.Network != "tcp" && c.Gateway.Network != "unix" {
+		add("gateway.network", `must be one of "tcp" or "unix", got %q`, c.Gateway.Network)
+	}
+	if (c.Gateway.TLSCertFile == "") != (c.Gateway.TLSKeyFile == "") {
+		add("gateway.tlsCertFile", "tlsCertFile and tlsKeyFile must be set together")
+	}
+
+	if c.Gateway.TrustedProxyHops < 0 {
+		add("gateway.trustedProxyHops", "must not be negative")
+	}
+	validateRateLimits(c, add)
+
+	if c.Auth.Enabled {
+		if _, err := url.ParseRequestURI(c.Auth.IssuerURL); err != nil {
+			add("auth.issuerUrl", "must be an absolute URL when auth is enabled")
+		}
+		if !c.Auth.ClientID.IsSet() {
+			add("auth.clientId", "is required when auth is enabled")
+		}
+		if len(c.Auth.Paths) == 0 {
+			add("auth.paths", "at least one path is required when auth is enabled")
+		}
+	}
+
+	for i, backend := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		if backend.Service == "" {
+			add(field+".service", "is required")
+		}
+		switch backend.Balancer {
+		case "", "round_robin", "least_request":
+		default:
+			add(field+".balancer", `must be one of "round_robin" or "least_request", got %q`, backend.Balancer)
+		}
+		if backend.SubConns < 0 {
+			add(field+".subConns", "must not be negative")
+		}
+		hosts := make(map[string]bool)
+		for j, addr := range backend.Addresses {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				add(fmt.Sprintf("%s.addresses[%d]", field, j), "must be host:port, got %q", addr)
+			}
+			hosts[host] = true
+		}
+		// the addresses are dialed as one target, which the certificate can't be verified against
+		tls := backend.TLS
+		if tls == nil {
+			tls = c.Gateway.BackendTLS
+		}
+		if tls != nil && tls.ServerName == "" && len(hosts) > 1 {
+			add(field+".tls.serverName", "is required over TLS when the addresses have different hosts")
+		}
+	}
+
+	if c.Database.URI.IsSet() || len(c.Database.Addresses()) > 0 || c.Database.Database != "" {
+		validateDatabase("database", c.Database, add)
+	}
+	for _, name := range c.databaseNames() {
+		if name == dbconfig.DefaultName {
+			add("databases."+name, "is reserved for the default database, use database instead")
+			continue
+		}
+		validateDatabase("databases."+name, c.Databases[name], add)
+	}
+
+	if c.Cache.DefaultExpiration < 0 {
+		add("cache.defaultExpiration", "must not be negative")
+	}
+	if c.Cache.CleanupInterval < 0 {
+		add("cache.cleanupInterval", "must not be negative")
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "", "info", "warning", "error":
+	default:
+		add("logging.level", `must be one of "info", "warning" or "error", got %q`, c.Logging.Level)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateRateLimits(c *ATKConfig, add func(field, format string, args ...interface{})) {
+	rateLimit := c.Gateway.RateLimit
+	validateRateLimit("gateway.rateLimit.default", rateLimit.Default, add)
+	routes := make([]string, 0, len(rateLimit.Routes))
+	for route := range rateLimit.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		validateRateLimit("gateway.rateLimit.routes."+route, rateLimit.Routes[route], add)
+	}
+	switch rateLimit.Store {
+	case "", "memory":
+	case "mongo":
+		if rateLimit.Enabled() && !c.Database.URI.IsSet() && len(c.Database.Addresses()) == 0 {
+			add("gateway.rateLimit.store", "the mongo store requires the database settings")
+		}
+	default:
+		add("gateway.rateLimit.store", `must be one of "memory" or "mongo", got %q`, rateLimit.Store)
+	}
+}
+
+func validateRateLimit(field string, limit RateLimit, add func(field, format string, args ...interface{})) {
+	if limit.Requests < 0 {
+		add(field+".requests", "must not be negative")
+	}
+	if limit.Period < 0 {
+		add(field+".period", "must not be negative")
+	}
+	if limit.Burst < 0 {
+		add(field+".burst", "must not be negative")
+	}
+}
+
+func validateDatabase(field string, db dbconfig.DBConfig, add func(field, format string, args ...interface{})) {
+	if err := db.Validate(); err != nil {
+		add(field, "%v", err)
+	}
+}
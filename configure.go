@@ -0,0 +1,146 @@
+package atk
+
+import (
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	atkconfig "github.com/lakstap/go-atk/config"
+	"github.com/lakstap/go-atk/gateway"
+)
+
+// WithConfig applies the loaded ATK configuration to the gateway. The backends
+// of the config are matched to the endpoint handlers by micro service name,
+// whatever the order of the options.
+func WithConfig(cfg *atkconfig.ATKConfig) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Addr = cfg.Gateway.Addr
+		gwOption.AdminAddr = cfg.Gateway.AdminAddr
+		gwOption.Env = cfg.Environment
+		gwOption.SwaggerDir = cfg.Gateway.SwaggerDir
+		if len(cfg.Gateway.Endpoints) > 0 {
+			gwOption.Endpoints = cfg.Gateway.Endpoints
+		}
+		gwOption.Network = cfg.Gateway.Network
+		gwOption.TLSCertFile = cfg.Gateway.TLSCertFile
+		gwOption.TLSKeyFile = cfg.Gateway.TLSKeyFile
+		gwOption.Auth = gateway.AuthConfig{
+			IssuerURL:             cfg.Auth.IssuerURL,
+			ClientID:              cfg.Auth.ClientID.Value(),
+			InsecureSkipVerify:    cfg.Auth.InsecureSkipVerify,
+			EventStreamTokenParam: cfg.Auth.EventStreamTokenParam,
+		}
+		gwOption.AuthPaths = nil
+		if cfg.Auth.Enabled {
+			gwOption.AuthPaths = cfg.Auth.Paths
+		}
+		gwOption.BackendTLS = toGatewayTLS(cfg.Gateway.BackendTLS)
+		if len(cfg.Gateway.CORS.AllowedOrigins) > 0 {
+			gwOption.CORS = &gateway.CORSConfig{
+				AllowedOrigins:   cfg.Gateway.CORS.AllowedOrigins,
+				AllowedMethods:   cfg.Gateway.CORS.AllowedMethods,
+				AllowedHeaders:   cfg.Gateway.CORS.AllowedHeaders,
+				AllowCredentials: cfg.Gateway.CORS.AllowCredentials,
+			}
+		}
+		gwOption.backendConfigs = cfg.Backends
+		gwOption.Headers.TrustedProxyHops = cfg.Gateway.TrustedProxyHops
+		gwOption.RateLimit, gwOption.rateLimitDB = nil, nil
+		if rateLimit := cfg.Gateway.RateLimit; rateLimit.Enabled() {
+			gwOption.RateLimit = &gateway.RateLimitConfig{
+				Default:          toGatewayRateLimit(rateLimit.Default),
+				Routes:           make(map[string]gateway.RateLimit, len(rateLimit.Routes)),
+				TrustedProxyHops: cfg.Gateway.TrustedProxyHops,
+			}
+			for route, limit := range rateLimit.Routes {
+				gwOption.RateLimit.Routes[route] = toGatewayRateLimit(limit)
+			}
+			if rateLimit.Store == "mongo" {
+				db := cfg.Database
+				gwOption.rateLimitDB = &db
+				gwOption.rateLimitCollection = rateLimit.StoreCollection
+			}
+		}
+		applyLoggingConfig(cfg.Logging)
+	}
+}
+
+// applyBackendConfigs overrides the connection settings of the backends
+// registered under a micro service name found in the config.
+func (gw *ATKGateway) applyBackendConfigs() {
+	for _, backendConfig := range gw.backendConfigs {
+		for i := range gw.Backends {
+			if gw.Backends[i].Service != backendConfig.Service {
+				continue
+			}
+			backend := &gw.Backends[i]
+			if len(backendConfig.Addresses) > 0 {
+				// static addresses take over from the registry
+				backend.Service = ""
+				backend.Addresses = backendConfig.Addresses
+			}
+			if backendConfig.Balancer != "" {
+				backend.Balancer = backendConfig.Balancer
+			}
+			if backendConfig.SubConns > 0 {
+				backend.SubConns = backendConfig.SubConns
+			}
+			if backendConfig.MaxRecvMsgSize > 0 {
+				backend.MaxRecvMsgSize = backendConfig.MaxRecvMsgSize
+			}
+			if backendConfig.MaxSendMsgSize > 0 {
+				backend.MaxSendMsgSize = backendConfig.MaxSendMsgSize
+			}
+			if backendConfig.TLS != nil {
+				backend.TLS = toGatewayTLS(backendConfig.TLS)
+			}
+		}
+	}
+}
+
+func toGatewayRateLimit(limit atkconfig.RateLimit) gateway.RateLimit {
+	return gateway.RateLimit{
+		Requests: limit.Requests,
+		Period:   time.Duration(limit.Period),
+		Burst:    limit.Burst,
+	}
+}
+
+func toGatewayTLS(tls *atkconfig.TLSConfig) *gateway.TLSConfig {
+	if tls == nil {
+		return nil
+	}
+	return &gateway.TLSConfig{
+		CAFile:             tls.CAFile,
+		ServerName:         tls.ServerName,
+		InsecureSkipVerify: tls.InsecureSkipVerify,
+	}
+}
+
+func toConfigTLS(tls *gateway.TLSConfig) *atkconfig.TLSConfig {
+	if tls == nil {
+		return nil
+	}
+	return &atkconfig.TLSConfig{
+		CAFile:             tls.CAFile,
+		ServerName:         tls.ServerName,
+		InsecureSkipVerify: tls.InsecureSkipVerify,
+	}
+}
+
+var applyLoggingOnce sync.Once
+
+// applyLoggingConfig sets the glog flags from the logging config. The flags are
+// process-wide, only the first config applied is taken, e.g. when a gateway and a
+// service run in the same binary.
+func applyLoggingConfig(logging atkconfig.LoggingConfig) {
+	applyLoggingOnce.Do(func() {
+		if logging.Level != "" {
+			flag.Set("stderrthreshold", strings.ToUpper(logging.Level))
+		}
+		if logging.ToStderr {
+			flag.Set("logtostderr", "true")
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package mdb
+
+import (
+	"context"
+	"encoding/base64"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ChangeEvent is a change of a document of a watched collection
+type ChangeEvent struct {
+	// OperationType is "insert", "update", "replace" or "delete", or "invalidate"
+	// when the collection is dropped or renamed
+	OperationType string
+
+	// DocumentID is the _id of the changed document
+	DocumentID interface{}
+
+	// FullDocument is the document after the change, for the inserts and replaces,
+	// and for the updates with WatchOptions.FullDocument
+	FullDocument bson.Raw
+
+	// UpdatedFields and RemovedFields describe the updates
+	UpdatedFields bson.Raw
+	RemovedFields []string
+
+	ClusterTime primitive.Timestamp
+
+	// ResumeToken is the opaque position of the event in the stream, e.g. the id of a
+	// Server-Sent Event, which WatchOptions.ResumeToken resumes after
+	ResumeToken string
+}
+
+// Decode decodes the full document of the event into v, e.g. a *Project.
+func (e ChangeEvent) Decode(v interface{}) error {
+	if e.FullDocument == nil {
+		return mongo.ErrNoDocuments
+	}
+	return bson.Unmarshal(e.FullDocument, v)
+}
+
+// WatchOptions selects the events of a change stream
+type WatchOptions struct {
+	// ResumeToken resumes the stream after the event of the token, e.g. the Last-Event-ID of a client
+	ResumeToken string
+
+	// Pipeline filters and shapes the events, e.g.
+	// mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	Pipeline interface{}
+
+	// FullDocument looks the current document up for the updates
+	FullDocument bool
+}
+
+type changeDocument struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	FullDocument  bson.Raw            `bson:"fullDocument"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// the server codes of the resume tokens which are too old to resume after
+var historyLostCodes = map[int32]bool{
+	280: true, // ChangeStreamFatalError
+	286: true, // ChangeStreamHistoryLost
+}
+
+// Watch calls handle with the changes of the collection until the context is done or handle
+// fails, e.g. to send them on a gRPC server stream. Change streams need a replica set.
+// The errors are gRPC status errors: an invalid resume token is InvalidArgument, one which is
+// too old to resume after is OutOfRange, the client should read the collection again.
+func (s *DatabaseSession) Watch(ctx context.Context, collection string, opts WatchOptions, handle func(ChangeEvent) error) error {
+	streamOptions := options.ChangeStream()
+	if opts.FullDocument {
+		streamOptions.SetFullDocument(options.UpdateLookup)
+	}
+	if opts.ResumeToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(opts.ResumeToken)
+		if err != nil || bson.Raw(token).Validate() != nil {
+			return status.Error(codes.InvalidArgument, "invalid resume token")
+		}
+		streamOptions.SetResumeAfter(bson.Raw(token))
+	}
+	pipeline := opts.Pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+
+	stream, err := s.Collection(collection).Watch(ctx, pipeline, streamOptions)
+	if err != nil {
+		return watchError(err, collection)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		change := changeDocument{}
+		if err := stream.Decode(&change); err != nil {
+			return StatusError(err, collection)
+		}
+		event := ChangeEvent{
+			OperationType: change.OperationType,
+			DocumentID:    change.DocumentKey.ID,
+			FullDocument:  change.FullDocument,
+			UpdatedFields: change.UpdateDescription.UpdatedFields,
+			RemovedFields: change.UpdateDescription.RemovedFields,
+			ClusterTime:   change.ClusterTime,
+			ResumeToken:   base64.RawURLEncoding.EncodeToString(change.ID),
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return watchError(err, collection)
+	}
+	return StatusError(ctx.Err(), collection)
+}
+
+func watchError(err error, collection string) error {
+	if commandErr, ok := err.(mongo.CommandError); ok && historyLostCodes[commandErr.Code] {
+		return status.Error(codes.OutOfRange, "the resume token is too old, read the "+collection+" again")
+	}
+	return StatusError(err, collection)
+}
+
+// Watch calls handle with the changes of the documents of the repository, see DatabaseSession.Watch.
+func (r *Repository) Watch(ctx context.Context, opts WatchOptions, handle func(ChangeEvent) error) error {
+	session := r.session()
+	if session == nil {
+		return r.error("watch", ErrNoSession)
+	}
+	return r.error("watch", session.Watch(ctx, r.collection, opts, handle))
+}
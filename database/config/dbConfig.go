@@ -2,20 +2,126 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/micro/go-config"
 	"github.com/micro/go-config/source/file"
+
+	"github.com/lakstap/go-atk/secrets"
 )
 
 
+// DefaultName is the name of the default database, the "hosts.database" entry of the config file
+const DefaultName = "database"
+
+// ReadPreferences are the read preferences a config may set
+var ReadPreferences = []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"}
+
 // define our own host type
+// the credentials may refer to secrets, e.g. "env:DB_PASSWORD" or "k8s:mongo/password"
 type DBConfig struct {
+	// URI is a MongoDB connection string, "mongodb://" or "mongodb+srv://", the fields
+	// below win over its settings. It may refer to a secret as it holds the credentials.
+	URI secrets.Secret `json:"uri"`
+
 	Address string `json:"address"`
 	Database string `json:"database"`
-	UserName string `json:"username"`
-	Password string `json:"password"`
+	UserName secrets.Secret `json:"username"`
+	Password secrets.Secret `json:"password"`
+
+	// Hosts are the host:port of the replica set members, besides Address
+	Hosts      []string `json:"hosts"`
+	ReplicaSet string   `json:"replicaSet"`
+
+	// AuthSource is the database of the credentials, Database when empty
+	AuthSource    string `json:"authSource"`
+	AuthMechanism string `json:"authMechanism"`
+
+	// TLS is used to connect when set
+	TLS *TLSConfig `json:"tls"`
+
+	// ReadPreference is one of ReadPreferences, reads are monotonic when it is empty
+	ReadPreference string `json:"readPreference"`
+
+	// PoolSize limits the connections to every server, the driver default is used when 0
+	PoolSize int `json:"poolSize"`
+
+	// ConnectTimeoutMS defaults to 60s, SocketTimeoutMS to the driver default
+	ConnectTimeoutMS int `json:"connectTimeoutMS"`
+	SocketTimeoutMS  int `json:"socketTimeoutMS"`
+
+	// Options are the other connection string options, passed to the driver as they are,
+	// e.g. retryWrites or w
+	Options map[string]string `json:"options"`
+}
+
+// TLSConfig configures the TLS connections to the database
+type TLSConfig struct {
+	// CAFile verifies the server certificates, the system roots are used when empty
+	CAFile string `json:"caFile"`
+
+	// CertFile and KeyFile are the client certificate, e.g. for the MONGODB-X509 mechanism.
+	// They may be the same PEM file.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// ResolveSecrets reads the uri and credentials the config refers to.
+func (c *DBConfig) ResolveSecrets() error {
+	if err := c.URI.Resolve(); err != nil {
+		return fmt.Errorf("uri: %v", err)
+	}
+	if err := c.UserName.Resolve(); err != nil {
+		return fmt.Errorf("username: %v", err)
+	}
+	if err := c.Password.Resolve(); err != nil {
+		return fmt.Errorf("password: %v", err)
+	}
+	return nil
+}
+
+
+// Validate checks the required settings of the config, along with its URI
+// when it is not a reference.
+func (c DBConfig) Validate() error {
+	if c.URI.IsSet() && !c.URI.IsReference() {
+		fromURI, _, err := parseURI(c.URI.Value())
+		if err != nil {
+			return err
+		}
+		c = c.merge(fromURI)
+	}
+	// the hosts and database may be in the uri the config refers to
+	unresolvedURI := c.URI.IsReference()
+	if len(c.Addresses()) == 0 && !unresolvedURI {
+		return fmt.Errorf("database address is required")
+	}
+	if c.Database == "" && !unresolvedURI {
+		return fmt.Errorf("database name is required")
+	}
+	if c.ReadPreference != "" && !validReadPreference(c.ReadPreference) {
+		return fmt.Errorf("read preference must be one of %s, got %q", strings.Join(ReadPreferences, ", "), c.ReadPreference)
+	}
+	if c.PoolSize < 0 {
+		return fmt.Errorf("pool size must not be negative")
+	}
+	if c.ConnectTimeoutMS < 0 || c.SocketTimeoutMS < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
 }
 
+func validReadPreference(readPreference string) bool {
+	for _, valid := range ReadPreferences {
+		if strings.EqualFold(readPreference, valid) {
+			return true
+		}
+	}
+	return false
+}
 
 // ReadConfig reads the config file
 func ReadConfig(fileConfig string) (DBConfig, error) {
@@ -36,7 +142,113 @@ func ReadConfig(fileConfig string) (DBConfig, error) {
 		return DBConfig{}, err
 	}
 
+	if err := dbConfig.ResolveSecrets(); err != nil {
+		fmt.Println(err)
+		return DBConfig{}, err
+	}
+
 	fmt.Println(dbConfig.Address)
 
 	return dbConfig, nil
-}
\ No newline at end of file
+}
+
+// ReadConfigs reads every database of the "hosts" section of the config file by name,
+// the default database is named DefaultName.
+func ReadConfigs(fileConfig string) (map[string]DBConfig, error) {
+
+	// load the config from a file source
+	if err := config.Load(file.NewSource(
+		file.WithPath(fileConfig),
+	)); err != nil {
+		return nil, err
+	}
+
+	dbConfigs := make(map[string]DBConfig)
+	if err := config.Get("hosts").Scan(&dbConfigs); err != nil {
+		return nil, err
+	}
+
+	for name, dbConfig := range dbConfigs {
+		if err := dbConfig.ResolveSecrets(); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		dbConfigs[name] = dbConfig
+	}
+	return dbConfigs, nil
+}
+
+const (
+	// maxWatchFailures is the number of watcher errors in a row after which the watch stops
+	maxWatchFailures = 10
+
+	// maxWatchBackoff bounds the wait between the watcher retries, doubled from a second
+	maxWatchBackoff = time.Minute
+)
+
+// WatchConfig calls onChange with the new database config every time it changes
+// in the config file, or with the error reading it. The watcher errors are retried with
+// a backoff, the watch stops after maxWatchFailures of them in a row: onChange gets the last
+// one wrapped. The returned function stops watching.
+func WatchConfig(fileConfig string, onChange func(DBConfig, error)) (func(), error) {
+	return WatchNamedConfig(fileConfig, DefaultName, onChange)
+}
+
+// WatchNamedConfig is WatchConfig for the "hosts.<name>" database of the config file.
+func WatchNamedConfig(fileConfig, name string, onChange func(DBConfig, error)) (func(), error) {
+	// a config of its own, the global one is shared with ReadConfig
+	conf := config.NewConfig()
+	if err := conf.Load(file.NewSource(
+		file.WithPath(fileConfig),
+	)); err != nil {
+		return nil, err
+	}
+
+	watcher, err := conf.Watch("hosts", name)
+	if err != nil {
+		conf.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		failures, backoff := 0, time.Second
+		for {
+			value, err := watcher.Next()
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err != nil {
+				if failures++; failures >= maxWatchFailures {
+					onChange(DBConfig{}, fmt.Errorf("stopped watching the database %s after %d errors: %v", name, failures, err))
+					return
+				}
+				onChange(DBConfig{}, err)
+				select {
+				case <-done:
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > maxWatchBackoff {
+					backoff = maxWatchBackoff
+				}
+				continue
+			}
+			failures, backoff = 0, time.Second
+
+			dbConfig := DBConfig{}
+			if err := value.Scan(&dbConfig); err != nil {
+				onChange(DBConfig{}, err)
+				continue
+			}
+			onChange(dbConfig, dbConfig.ResolveSecrets())
+		}
+	}()
+
+	return func() {
+		close(done)
+		watcher.Stop()
+		conf.Close()
+	}, nil
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+
+	"github.com/lakstap/go-atk/secrets"
+)
+
+// ApplyURI returns the config with the settings of its URI filled in, the fields
+// set in the config itself win over the URI. The hosts of a "mongodb+srv://" URI
+// are looked up in DNS, along with the options of its TXT record.
+func (c DBConfig) ApplyURI() (DBConfig, error) {
+	if !c.URI.IsSet() {
+		return c, nil
+	}
+	uri, err := c.URI.Read()
+	if err != nil {
+		return c, fmt.Errorf("uri: %v", err)
+	}
+	fromURI, srv, err := parseURI(uri)
+	if err != nil {
+		return c, err
+	}
+	if srv != "" {
+		if fromURI, err = lookupSRV(srv, fromURI); err != nil {
+			return c, err
+		}
+	}
+	return c.merge(fromURI), nil
+}
+
+// Addresses returns the hosts of the config, the legacy Address first.
+func (c DBConfig) Addresses() []string {
+	var addrs []string
+	if c.Address != "" {
+		addrs = append(addrs, c.Address)
+	}
+	return append(addrs, c.Hosts...)
+}
+
+// merge fills the fields which are not set with the ones of the URI.
+func (c DBConfig) merge(fromURI DBConfig) DBConfig {
+	if c.Address == "" && len(c.Hosts) == 0 {
+		c.Hosts = fromURI.Hosts
+	}
+	if c.Database == "" {
+		c.Database = fromURI.Database
+	}
+	if !c.UserName.IsSet() {
+		c.UserName = fromURI.UserName
+	}
+	if !c.Password.IsSet() {
+		c.Password = fromURI.Password
+	}
+	if c.ReplicaSet == "" {
+		c.ReplicaSet = fromURI.ReplicaSet
+	}
+	if c.AuthSource == "" {
+		c.AuthSource = fromURI.AuthSource
+	}
+	if c.AuthMechanism == "" {
+		c.AuthMechanism = fromURI.AuthMechanism
+	}
+	if c.TLS == nil {
+		c.TLS = fromURI.TLS
+	}
+	if c.ReadPreference == "" {
+		c.ReadPreference = fromURI.ReadPreference
+	}
+	if c.PoolSize == 0 {
+		c.PoolSize = fromURI.PoolSize
+	}
+	if c.ConnectTimeoutMS == 0 {
+		c.ConnectTimeoutMS = fromURI.ConnectTimeoutMS
+	}
+	if c.SocketTimeoutMS == 0 {
+		c.SocketTimeoutMS = fromURI.SocketTimeoutMS
+	}
+	if len(fromURI.Options) > 0 {
+		options := make(map[string]string, len(fromURI.Options)+len(c.Options))
+		for name, value := range fromURI.Options {
+			options[name] = value
+		}
+		for name, value := range c.Options {
+			options[name] = value
+		}
+		c.Options = options
+	}
+	return c
+}
+
+// parseURI reads the settings of a MongoDB connection string, returning the
+// host to look up when it is a "mongodb+srv://" one.
+func parseURI(uri string) (DBConfig, string, error) {
+	var c DBConfig
+	srv := strings.HasPrefix(uri, connstring.SchemeMongoDBSRV+"://")
+	toParse := uri
+	if srv {
+		// the hosts are looked up by ApplyURI, the validation doesn't query DNS
+		toParse = connstring.SchemeMongoDB + "://" + strings.TrimPrefix(uri, connstring.SchemeMongoDBSRV+"://")
+	}
+	cs, err := connstring.Parse(toParse)
+	if err != nil {
+		return c, "", fmt.Errorf("invalid database uri: %v", redactURIError(err))
+	}
+
+	c.Hosts = cs.Hosts
+	srvHost := ""
+	if srv {
+		if len(cs.Hosts) != 1 || strings.Contains(cs.Hosts[0], ":") {
+			return c, "", fmt.Errorf("invalid database uri: a mongodb+srv uri takes a single host name without port")
+		}
+		srvHost = cs.Hosts[0]
+		// TLS is on by default for SRV connection strings
+		c.TLS = &TLSConfig{}
+	}
+	if cs.Username != "" {
+		c.UserName = secrets.Plain(cs.Username)
+	}
+	if cs.PasswordSet {
+		c.Password = secrets.Plain(cs.Password)
+	}
+	c.Database = cs.Database
+
+	// the option names are lower cased by the parser
+	if err := c.applyOptions(url.Values(cs.Options)); err != nil {
+		return c, "", err
+	}
+	return c, srvHost, nil
+}
+
+// applyOptions sets the connection string options, their names are case insensitive.
+// The options without a field are kept in Options for the driver.
+func (c *DBConfig) applyOptions(options url.Values) error {
+	for name, values := range options {
+		value := values[len(values)-1]
+		var err error
+		switch strings.ToLower(name) {
+		case "replicaset":
+			c.ReplicaSet = value
+		case "authsource":
+			c.AuthSource = value
+		case "authmechanism":
+			c.AuthMechanism = value
+		case "ssl", "tls":
+			var enabled bool
+			if enabled, err = strconv.ParseBool(value); enabled && c.TLS == nil {
+				c.TLS = &TLSConfig{}
+			} else if err == nil && !enabled {
+				c.TLS = nil
+			}
+		case "tlscafile":
+			c.tls().CAFile = value
+		case "tlscertificatekeyfile":
+			c.tls().CertFile = value
+			c.tls().KeyFile = value
+		case "tlsinsecure", "tlsallowinvalidcertificates":
+			c.tls().InsecureSkipVerify, err = strconv.ParseBool(value)
+		case "readpreference":
+			c.ReadPreference = value
+		case "maxpoolsize":
+			c.PoolSize, err = strconv.Atoi(value)
+		case "connecttimeoutms":
+			c.ConnectTimeoutMS, err = strconv.Atoi(value)
+		case "sockettimeoutms":
+			c.SocketTimeoutMS, err = strconv.Atoi(value)
+		default:
+			if c.Options == nil {
+				c.Options = make(map[string]string)
+			}
+			c.Options[name] = value
+		}
+		if err != nil {
+			return fmt.Errorf("invalid database uri: option %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *DBConfig) tls() *TLSConfig {
+	if c.TLS == nil {
+		c.TLS = &TLSConfig{}
+	}
+	return c.TLS
+}
+
+// lookupSRV resolves the hosts of a "mongodb+srv://" host name, and the
+// replicaSet and authSource options of its TXT record.
+func lookupSRV(host string, c DBConfig) (DBConfig, error) {
+	_, records, err := net.LookupSRV("mongodb", "tcp", host)
+	if err != nil {
+		return c, fmt.Errorf("failed to look up the database hosts of %s: %v", host, err)
+	}
+	c.Hosts = nil
+	for _, record := range records {
+		c.Hosts = append(c.Hosts, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+
+	txts, err := net.LookupTXT(host)
+	if err != nil {
+		// the TXT record is optional
+		return c, nil
+	}
+	for _, txt := range txts {
+		options, err := url.ParseQuery(txt)
+		if err != nil {
+			return c, fmt.Errorf("invalid TXT record of %s: %v", host, err)
+		}
+		// the options of the URI itself win
+		fromTXT := DBConfig{}
+		if err := fromTXT.applyOptions(options); err != nil {
+			return c, err
+		}
+		if c.ReplicaSet == "" {
+			c.ReplicaSet = fromTXT.ReplicaSet
+		}
+		if c.AuthSource == "" {
+			c.AuthSource = fromTXT.AuthSource
+		}
+	}
+	return c, nil
+}
+
+// redactURIError drops the password of the URI from the parse error, e.g.
+// "invalid password: invalid URL escape ..." whose escape is a piece of it.
+func redactURIError(err error) error {
+	message := err.Error()
+	if i := strings.Index(message, "password"); i >= 0 {
+		return errors.New(message[:i+len("password")])
+	}
+	return err
+}
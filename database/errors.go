@@ -0,0 +1,101 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoSession is returned when the database of a repository is not dialed
+var ErrNoSession = errors.New("mdb: no database session")
+
+// duplicate key error codes of the server
+var duplicateKeyCodes = map[int]bool{11000: true, 11001: true, 12582: true}
+
+// IsDuplicateKey reports whether the error is a unique index violation.
+func IsDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, writeErr := range e.WriteErrors {
+			if duplicateKeyCodes[writeErr.Code] {
+				return true
+			}
+		}
+	case mongo.BulkWriteException:
+		for _, writeErr := range e.WriteErrors {
+			if duplicateKeyCodes[writeErr.Code] {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return duplicateKeyCodes[int(e.Code)]
+	}
+	return false
+}
+
+// IsTransientTransactionError reports whether the transaction failed on a transient error,
+// e.g. a write conflict or an election, and may be retried as a whole.
+func IsTransientTransactionError(err error) bool {
+	return hasErrorLabel(err, "TransientTransactionError")
+}
+
+func hasErrorLabel(err error, label string) bool {
+	if e, ok := err.(mongo.CommandError); ok {
+		return e.HasErrorLabel(label)
+	}
+	return false
+}
+
+// StatusError maps a database error to a gRPC status error: NotFound for no document,
+// AlreadyExists for a duplicate key, Unavailable without session, Canceled and
+// DeadlineExceeded for the context, Internal otherwise. The details of the internal
+// errors are not sent to the client.
+func StatusError(err error, what string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case isError(err, mongo.ErrNoDocuments):
+		return status.Errorf(codes.NotFound, "%s not found", what)
+	case IsDuplicateKey(err):
+		return status.Errorf(codes.AlreadyExists, "%s already exists", what)
+	case isError(err, ErrNoSession):
+		return status.Errorf(codes.Unavailable, "the %s are not available", what)
+	case isError(err, context.Canceled):
+		return status.Error(codes.Canceled, context.Canceled.Error())
+	case isError(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, context.DeadlineExceeded.Error())
+	}
+	return status.Errorf(codes.Internal, "failed to access the %s", what)
+}
+
+// isError reports whether err is target or wraps it, as errors.Is does: through the
+// Unwrap and Cause methods, and the wrapped errors of the driver connections.
+func isError(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case topology.ConnectionError:
+			err = e.Wrapped
+		case driver.ResponseError:
+			err = e.Wrapped
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,384 @@
+package mdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Index is an index of a collection managed by the service
+type Index struct {
+	// Name of the index, named after its keys like the driver does when empty, e.g. "owner_1_created_-1"
+	Name string `json:"name"`
+
+	// Keys of the index in order: "field" ascending, "-field" descending, "text:field" for text indexes
+	Keys []string `json:"keys"`
+
+	Unique bool `json:"unique"`
+	Sparse bool `json:"sparse"`
+
+	// ExpireAfterSeconds makes a TTL index on a date field
+	ExpireAfterSeconds *int32 `json:"expireAfterSeconds"`
+
+	// PartialFilter indexes the documents matching the filter only
+	PartialFilter map[string]interface{} `json:"partialFilter"`
+}
+
+// IndexChange is a difference between the declared and the existing indexes
+type IndexChange struct {
+	Collection string
+	Index      string
+
+	// Action is "create", "recreate" when the declared index differs from the existing one
+	// and Recreate is set, "changed" when it differs and is kept as is, "drop" for an unmanaged
+	// index, or "unmanaged" when unmanaged indexes are kept
+	Action string
+}
+
+func (c IndexChange) String() string {
+	return fmt.Sprintf("%s %s.%s", c.Action, c.Collection, c.Index)
+}
+
+// EnsureOptions controls EnsureIndexes
+type EnsureOptions struct {
+	// DryRun only returns the changes
+	DryRun bool
+
+	// DropUnmanaged drops the indexes which are not declared, in the collections with declared indexes
+	DropUnmanaged bool
+
+	// Recreate drops and creates again the indexes which differ from their declaration. The
+	// collection is without the index in between, e.g. without its unique constraint, and keeps
+	// none if the creation fails. The indexes which differ are only reported otherwise.
+	Recreate bool
+}
+
+// server error codes of the concurrent index changes
+const (
+	indexNotFoundCode         = 27
+	indexOptionsConflictCode  = 85
+	indexKeySpecsConflictCode = 86
+)
+
+var (
+	indexesMu sync.Mutex
+	indexes   = make(map[string][]Index)
+)
+
+// RegisterIndexes declares indexes of a collection of the default database, they are
+// ensured by the database service type at startup, e.g. from the init of a service package.
+func RegisterIndexes(collection string, declared ...Index) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	indexes[collection] = append(indexes[collection], declared...)
+}
+
+// RegisteredIndexes returns the indexes declared with RegisterIndexes, by collection.
+func RegisteredIndexes() map[string][]Index {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	registered := make(map[string][]Index, len(indexes))
+	for collection, declared := range indexes {
+		registered[collection] = append([]Index(nil), declared...)
+	}
+	return registered
+}
+
+// EnsureIndexes creates the declared indexes of every collection which are missing, recreates
+// the ones which differ with Recreate, and returns the changes. Nothing is changed in dry-run mode.
+// The replicas may ensure the indexes at the same time.
+func (s *DatabaseSession) EnsureIndexes(ctx context.Context, declared map[string][]Index, opts EnsureOptions) ([]IndexChange, error) {
+	collections := make([]string, 0, len(declared))
+	for collection := range declared {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	var changes []IndexChange
+	for _, collection := range collections {
+		collChanges, err := s.ensureCollectionIndexes(ctx, collection, declared[collection], opts)
+		changes = append(changes, collChanges...)
+		if err != nil {
+			return changes, fmt.Errorf("indexes of %s: %v", collection, err)
+		}
+	}
+	return changes, nil
+}
+
+func (s *DatabaseSession) ensureCollectionIndexes(ctx context.Context, collection string, declared []Index, opts EnsureOptions) ([]IndexChange, error) {
+	view := s.Collection(collection).Indexes()
+	existing, err := listIndexes(ctx, view)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []IndexChange
+	managed := map[string]bool{"_id_": true}
+	for _, index := range declared {
+		model, err := index.model()
+		if err != nil {
+			return changes, err
+		}
+		name := *model.Options.Name
+		managed[name] = true
+
+		current, ok := existing[name]
+		change := IndexChange{Collection: collection, Index: name, Action: "create"}
+		if ok {
+			if index.matches(current) {
+				continue
+			}
+			change.Action = "recreate"
+			if !opts.Recreate {
+				change.Action = "changed"
+			}
+		}
+		changes = append(changes, change)
+		if opts.DryRun || change.Action == "changed" {
+			continue
+		}
+		if change.Action == "recreate" {
+			// dropped already by another replica
+			if _, err := view.DropOne(ctx, name); err != nil && !hasErrorCode(err, indexNotFoundCode) {
+				return changes, err
+			}
+		}
+		if _, err := view.CreateOne(ctx, model); err != nil {
+			if !hasErrorCode(err, indexOptionsConflictCode, indexKeySpecsConflictCode) {
+				return changes, err
+			}
+			// created by another replica meanwhile, fine if it is the declared one
+			current, listErr := listIndexes(ctx, view)
+			if listErr != nil {
+				return changes, listErr
+			}
+			if !index.matches(current[name]) {
+				return changes, err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(existing))
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if managed[name] {
+			continue
+		}
+		change := IndexChange{Collection: collection, Index: name, Action: "unmanaged"}
+		if opts.DropUnmanaged {
+			change.Action = "drop"
+		}
+		changes = append(changes, change)
+		if opts.DropUnmanaged && !opts.DryRun {
+			if _, err := view.DropOne(ctx, name); err != nil && !hasErrorCode(err, indexNotFoundCode) {
+				return changes, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+// hasErrorCode reports whether the error is a server error of one of the codes.
+func hasErrorCode(err error, codes ...int32) bool {
+	commandErr, ok := err.(mongo.CommandError)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if commandErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// listIndexes returns the specifications of the indexes of the collection by name, their keys in order.
+func listIndexes(ctx context.Context, view mongo.IndexView) (map[string]bson.M, error) {
+	cursor, err := view.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	existing := make(map[string]bson.M)
+	for cursor.Next(ctx) {
+		spec := bson.M{}
+		if err := cursor.Decode(&spec); err != nil {
+			return nil, err
+		}
+		// the order of the keys makes the index, a map would lose it
+		keys := bson.D{}
+		if err := cursor.Current.Lookup("key").Unmarshal(&keys); err != nil {
+			return nil, err
+		}
+		spec["key"] = keys
+		name, _ := spec["name"].(string)
+		existing[name] = spec
+	}
+	return existing, cursor.Err()
+}
+
+// keys returns the key document of the index, the text fields being weighted by the server.
+func (index Index) keys() (bson.D, error) {
+	if len(index.Keys) == 0 {
+		return nil, fmt.Errorf("index %q has no keys", index.Name)
+	}
+	keys := bson.D{}
+	for _, key := range index.Keys {
+		switch {
+		case strings.HasPrefix(key, "text:"):
+			keys = append(keys, bson.E{Key: strings.TrimPrefix(key, "text:"), Value: "text"})
+		case strings.HasPrefix(key, "-"):
+			keys = append(keys, bson.E{Key: strings.TrimPrefix(key, "-"), Value: -1})
+		default:
+			keys = append(keys, bson.E{Key: key, Value: 1})
+		}
+	}
+	return keys, nil
+}
+
+func (index Index) model() (mongo.IndexModel, error) {
+	keys, err := index.keys()
+	if err != nil {
+		return mongo.IndexModel{}, err
+	}
+	name := index.Name
+	if name == "" {
+		var parts []string
+		for _, key := range keys {
+			parts = append(parts, fmt.Sprintf("%s_%v", key.Key, key.Value))
+		}
+		name = strings.Join(parts, "_")
+	}
+
+	indexOptions := options.Index().SetName(name)
+	if index.Unique {
+		indexOptions.SetUnique(true)
+	}
+	if index.Sparse {
+		indexOptions.SetSparse(true)
+	}
+	if index.ExpireAfterSeconds != nil {
+		indexOptions.SetExpireAfterSeconds(*index.ExpireAfterSeconds)
+	}
+	if index.PartialFilter != nil {
+		indexOptions.SetPartialFilterExpression(index.PartialFilter)
+	}
+	return mongo.IndexModel{Keys: keys, Options: indexOptions}, nil
+}
+
+// matches reports whether the existing index has the keys and options of the declared one.
+func (index Index) matches(spec bson.M) bool {
+	keys, err := index.keys()
+	if err != nil {
+		return false
+	}
+	var declaredKeys, declaredText []string
+	for _, key := range keys {
+		if key.Value == "text" {
+			declaredText = append(declaredText, key.Key)
+		} else {
+			declaredKeys = append(declaredKeys, fmt.Sprintf("%s:%v", key.Key, key.Value))
+		}
+	}
+
+	// the server stores the text fields as weights
+	var existingKeys, existingText []string
+	for _, key := range orderedKeys(spec["key"]) {
+		if key.Key == "_fts" || key.Key == "_ftsx" {
+			continue
+		}
+		existingKeys = append(existingKeys, fmt.Sprintf("%s:%v", key.Key, normalizeIndexValue(key.Value)))
+	}
+	if weights, ok := spec["weights"]; ok {
+		for _, weight := range orderedKeys(weights) {
+			existingText = append(existingText, weight.Key)
+		}
+	}
+	sort.Strings(declaredText)
+	sort.Strings(existingText)
+
+	unique, _ := spec["unique"].(bool)
+	sparse, _ := spec["sparse"].(bool)
+	var ttl interface{}
+	if index.ExpireAfterSeconds != nil {
+		ttl = float64(*index.ExpireAfterSeconds)
+	}
+	return reflect.DeepEqual(declaredKeys, existingKeys) &&
+		reflect.DeepEqual(declaredText, existingText) &&
+		unique == index.Unique &&
+		sparse == index.Sparse &&
+		reflect.DeepEqual(ttl, normalizeIndexValue(spec["expireAfterSeconds"])) &&
+		reflect.DeepEqual(normalizeIndexValue(index.PartialFilter), normalizeIndexValue(spec["partialFilterExpression"]))
+}
+
+func orderedKeys(doc interface{}) bson.D {
+	switch d := doc.(type) {
+	case bson.D:
+		return d
+	case bson.M:
+		keys := bson.D{}
+		for key, value := range d {
+			keys = append(keys, bson.E{Key: key, Value: value})
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+		return keys
+	}
+	return nil
+}
+
+// normalizeIndexValue turns the documents into maps and the numbers into float64, to compare
+// the declared and the stored specifications.
+func normalizeIndexValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		if v == nil {
+			return nil
+		}
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[key] = normalizeIndexValue(item)
+		}
+		return normalized
+	case bson.M:
+		return normalizeIndexValue(map[string]interface{}(v))
+	case bson.D:
+		normalized := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			normalized[e.Key] = normalizeIndexValue(e.Value)
+		}
+		return normalized
+	case bson.A:
+		return normalizeIndexValue([]interface{}(v))
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeIndexValue(item)
+		}
+		return normalized
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case primitive.Decimal128:
+		return v.String()
+	}
+	return value
+}
@@ -0,0 +1,89 @@
+package mdb
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/lakstap/go-atk/database/config"
+)
+
+// ErrNoLegacyAdapter is returned by Legacy for the sessions without mgo session, dialed
+// with NoLegacyAdapter or whose mgo dial failed
+var ErrNoLegacyAdapter = errors.New("mdb: the session has no mgo adapter")
+
+// Legacy returns the mgo session of the adapter, which the session also embeds.
+// Deprecated: use Database or Collection
+func (s *DatabaseSession) Legacy() (*mgo.Session, error) {
+	if s.Session == nil {
+		return nil, ErrNoLegacyAdapter
+	}
+	return s.Session, nil
+}
+
+// dialLegacy dials the mgo session of the config, its URI being applied already.
+func dialLegacy(DBConfig config.DBConfig) (*mgo.Session, error) {
+	mode, err := readMode(DBConfig.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+
+	// establish mongo db session.
+	mongoDBDialInfo := &mgo.DialInfo{
+		Addrs:          DBConfig.Addresses(),
+		Timeout:        connectTimeout(DBConfig),
+		Database:       DBConfig.Database,
+		ReplicaSetName: DBConfig.ReplicaSet,
+		Source:         DBConfig.AuthSource,
+		Mechanism:      DBConfig.AuthMechanism,
+		Username:       DBConfig.UserName.Value(),
+		Password:       DBConfig.Password.Value(),
+		PoolLimit:      DBConfig.PoolSize,
+	}
+	if DBConfig.TLS != nil {
+		tlsConfig, err := clientTLSConfig(DBConfig.TLS)
+		if err != nil {
+			return nil, err
+		}
+		mongoDBDialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: mongoDBDialInfo.Timeout}
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), tlsConfig)
+		}
+	}
+
+	// Create a session which maintains a pool of socket connections
+	// to our MongoDB.
+	mongoSession, err := mgo.DialWithInfo(mongoDBDialInfo)
+	if err != nil {
+		return nil, err
+	}
+	mongoSession.SetMode(mode, true)
+	if DBConfig.SocketTimeoutMS > 0 {
+		mongoSession.SetSocketTimeout(time.Duration(DBConfig.SocketTimeoutMS) * time.Millisecond)
+	}
+	return mongoSession, nil
+}
+
+// readMode returns the session mode of the read preference, monotonic when it is empty.
+func readMode(readPreference string) (mgo.Mode, error) {
+	switch strings.ToLower(readPreference) {
+	case "":
+		return mgo.Monotonic, nil
+	case "primary":
+		return mgo.Primary, nil
+	case "primarypreferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary":
+		return mgo.Secondary, nil
+	case "secondarypreferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+	return 0, fmt.Errorf("unknown read preference %q", readPreference)
+}
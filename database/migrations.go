@@ -0,0 +1,325 @@
+package mdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micro/go-log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a versioned change of the schema or the data of a database
+type Migration struct {
+	// Version orders the migrations, e.g. 20260101120000
+	Version     int64
+	Description string
+
+	Up func(ctx context.Context, db *mongo.Database) error
+
+	// Down reverts Up, migrations without Down can't be rolled back
+	Down func(ctx context.Context, db *mongo.Database) error
+}
+
+// MigrationStatus tells whether a migration is applied
+type MigrationStatus struct {
+	Version     int64
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+const (
+	// MigrationsCollection records the applied migrations
+	MigrationsCollection = "atk_migrations"
+
+	// MigrationsLockCollection holds the lock of the migrations
+	MigrationsLockCollection = "atk_migrations_lock"
+
+	migrationsLockID = "lock"
+)
+
+// DefaultMigrationLockTTL is how long a lock lives without being refreshed,
+// the lock of a replica which died is taken over after it.
+var DefaultMigrationLockTTL = time.Minute
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = make(map[int64]Migration)
+)
+
+// RegisterMigration adds a migration of the default database, e.g. from the init of a service package.
+// It panics when the version is registered twice.
+func RegisterMigration(migration Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if _, ok := migrations[migration.Version]; ok {
+		panic(fmt.Sprintf("mdb: migration %d registered twice", migration.Version))
+	}
+	migrations[migration.Version] = migration
+}
+
+// RegisteredMigrations returns the registered migrations ordered by version.
+func RegisteredMigrations() []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	registered := make([]Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		registered = append(registered, migration)
+	}
+	sortMigrations(registered)
+	return registered
+}
+
+func sortMigrations(migrations []Migration) {
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+}
+
+// ErrMigrationLocked is returned when another replica holds the migrations lock
+var ErrMigrationLocked = errors.New("mdb: the migrations are locked by another replica")
+
+// ErrMigrationLockLost is returned when the lock expired during the migrations, e.g. the database
+// was unreachable, and another replica may have taken it over. The running migration is canceled.
+var ErrMigrationLockLost = errors.New("mdb: the migrations lock was lost")
+
+// Migrator applies and reverts migrations, holding a lock document so a single replica
+// migrates at a time.
+type Migrator struct {
+	session    *DatabaseSession
+	migrations []Migration
+
+	// LockTTL is DefaultMigrationLockTTL by default
+	LockTTL time.Duration
+
+	// Owner identifies the replica in the lock document, its host name and pid by default
+	Owner string
+}
+
+// NewMigrator returns the migrator of the migrations, the registered ones when none are given.
+func NewMigrator(session *DatabaseSession, migrations ...Migration) *Migrator {
+	if len(migrations) == 0 {
+		migrations = RegisteredMigrations()
+	} else {
+		migrations = append([]Migration(nil), migrations...)
+		sortMigrations(migrations)
+	}
+	host, _ := os.Hostname()
+	return &Migrator{
+		session:    session,
+		migrations: migrations,
+		LockTTL:    DefaultMigrationLockTTL,
+		Owner:      fmt.Sprintf("%s-%d", host, os.Getpid()),
+	}
+}
+
+type migrationRecord struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Status returns the status of every migration, ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		record, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Applied:     ok,
+			AppliedAt:   record.AppliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Up applies the migrations which are not applied yet, in order, and returns their versions.
+// It waits for the lock while another replica migrates.
+func (m *Migrator) Up(ctx context.Context) (done []int64, err error) {
+	ctx, unlock, err := m.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if lockErr := unlock(); lockErr != nil {
+			err = lockErr
+		}
+	}()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		log.Logf("Applying migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Up(ctx, m.session.Database()); err != nil {
+			return done, fmt.Errorf("migration %d: %v", migration.Version, err)
+		}
+		record := migrationRecord{Version: migration.Version, Description: migration.Description, AppliedAt: time.Now()}
+		if _, err := m.session.Collection(MigrationsCollection).InsertOne(ctx, record); err != nil {
+			return done, fmt.Errorf("migration %d was applied but not recorded: %v", migration.Version, err)
+		}
+		done = append(done, migration.Version)
+	}
+	return done, nil
+}
+
+// DownTo reverts the applied migrations above the version, newest first, and returns their versions.
+func (m *Migrator) DownTo(ctx context.Context, version int64) (done []int64, err error) {
+	ctx, unlock, err := m.lock(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if lockErr := unlock(); lockErr != nil {
+			err = lockErr
+		}
+	}()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return done, fmt.Errorf("migration %d can't be reverted", migration.Version)
+		}
+		log.Logf("Reverting migration %d: %s", migration.Version, migration.Description)
+		if err := migration.Down(ctx, m.session.Database()); err != nil {
+			return done, fmt.Errorf("migration %d: %v", migration.Version, err)
+		}
+		if _, err := m.session.Collection(MigrationsCollection).DeleteOne(ctx, bson.M{"_id": migration.Version}); err != nil {
+			return done, fmt.Errorf("migration %d was reverted but is still recorded: %v", migration.Version, err)
+		}
+		done = append(done, migration.Version)
+	}
+	return done, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]migrationRecord, error) {
+	cursor, err := m.session.Collection(MigrationsCollection).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	applied := make(map[int64]migrationRecord)
+	for cursor.Next(ctx) {
+		record := migrationRecord{}
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		applied[record.Version] = record
+	}
+	return applied, cursor.Err()
+}
+
+// lock takes the migrations lock, waiting for it when wait is set, and keeps it alive until
+// the returned function releases it. The returned context is canceled when the lock is lost,
+// the release then returns ErrMigrationLockLost.
+func (m *Migrator) lock(ctx context.Context, wait bool) (context.Context, func() error, error) {
+	if m.LockTTL <= 0 {
+		return nil, nil, fmt.Errorf("mdb: invalid migrations lock TTL %v", m.LockTTL)
+	}
+	locks := m.session.Collection(MigrationsLockCollection)
+	for {
+		acquired, err := m.tryLock(ctx, locks)
+		if err != nil {
+			return nil, nil, err
+		}
+		if acquired {
+			break
+		}
+		if !wait {
+			return nil, nil, ErrMigrationLocked
+		}
+		log.Log("Waiting for the migrations lock held by another replica..")
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	done, exited := make(chan struct{}), make(chan struct{})
+	lost := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(m.LockTTL / 3)
+		defer ticker.Stop()
+		refreshed := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				result, err := locks.UpdateOne(context.Background(),
+					bson.M{"_id": migrationsLockID, "owner": m.Owner},
+					bson.M{"$set": bson.M{"expireAt": time.Now().Add(m.LockTTL)}})
+				switch {
+				case err == nil && result.MatchedCount > 0:
+					refreshed = time.Now()
+					continue
+				case err != nil && time.Since(refreshed) < m.LockTTL:
+					log.Logf("Failed to refresh the migrations lock: %v", err)
+					continue
+				}
+				// taken over by another replica, or expired
+				log.Log("Lost the migrations lock, canceling the migration")
+				close(lost)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return lockCtx, func() error {
+		close(done)
+		<-exited
+		cancel()
+		select {
+		case <-lost:
+			return ErrMigrationLockLost
+		default:
+		}
+		if _, err := locks.DeleteOne(context.Background(), bson.M{"_id": migrationsLockID, "owner": m.Owner}); err != nil {
+			log.Logf("Failed to release the migrations lock: %v", err)
+		}
+		return nil
+	}, nil
+}
+
+// tryLock inserts the lock document, or takes it over when it expired.
+func (m *Migrator) tryLock(ctx context.Context, locks *mongo.Collection) (bool, error) {
+	now := time.Now()
+	_, err := locks.UpdateOne(ctx,
+		bson.M{"_id": migrationsLockID, "expireAt": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": m.Owner, "expireAt": now.Add(m.LockTTL)}},
+		options.Update().SetUpsert(true))
+	if IsDuplicateKey(err) {
+		// the lock is held and alive
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -1,34 +1,322 @@
 package mdb
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"github.com/micro/go-log"
+	"strings"
+	"sync"
 	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"gopkg.in/mgo.v2"
 
 	"github.com/lakstap/go-atk/database/config"
 )
 
+// DatabaseSession is the client of a database, built on the official MongoDB driver.
+// The mgo methods of the previous session are kept by the adapter during the migration
+// from mgo only, see mgo-compat.go.
 type DatabaseSession struct {
+	// Session is the mgo session of the adapter, nil when dialed with NoLegacyAdapter
+	// or when mgo could not connect, e.g. to MongoDB 6+ or with SCRAM-SHA-256 only users.
+	// It is only there for the transition and will be removed.
+	// Deprecated: use Database or Collection
 	*mgo.Session
+
+	client       *mongo.Client
 	databaseName string
+	closeOnce    sync.Once
+}
+
+// closeTimeout bounds the disconnection of Close
+const closeTimeout = 10 * time.Second
+
+// Client returns the driver client of the session.
+func (s *DatabaseSession) Client() *mongo.Client {
+	return s.client
+}
+
+// Database returns the database of the config.
+func (s *DatabaseSession) Database() *mongo.Database {
+	return s.client.Database(s.databaseName)
+}
+
+// Collection returns the collection of the database of the config.
+func (s *DatabaseSession) Collection(name string) *mongo.Collection {
+	return s.Database().Collection(name)
+}
+
+// DatabaseName returns the name of the database of the config.
+func (s *DatabaseSession) DatabaseName() string {
+	return s.databaseName
+}
+
+// PingContext checks the connection to the primary, or the server of the read preference.
+// Ping is the one of the mgo session.
+func (s *DatabaseSession) PingContext(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
+// Disconnect closes the connections of the session once the operations in flight are done.
+func (s *DatabaseSession) Disconnect(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.Session != nil {
+			s.Session.Close()
+		}
+		err = s.client.Disconnect(ctx)
+	})
+	return err
+}
+
+// Close disconnects the session, giving up after 10 seconds.
+func (s *DatabaseSession) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := s.Disconnect(ctx); err != nil {
+		log.Logf("Failed to disconnect from the database %s: %v", s.databaseName, err)
+	}
+}
+
+// DialOptions controls the retries of the session dial
+type DialOptions struct {
+	// Retries is the number of dials after the first failed one
+	Retries int
+
+	// Backoff is the wait before the first retry, doubled up to MaxBackoff after every failure
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// NoLegacyAdapter skips the mgo session of the adapter, for the services which
+	// don't call the mgo methods of the session anymore. Otherwise the adapter is
+	// dialed best effort: the session is returned without it when mgo fails.
+	NoLegacyAdapter bool
+}
+
+// DefaultDialOptions retries the dial for about half a minute.
+var DefaultDialOptions = DialOptions{
+	Retries:    5,
+	Backoff:    time.Second,
+	MaxBackoff: 10 * time.Second,
 }
 
+// DialError is returned when no session could be dialed
+type DialError struct {
+	Address  string
+	Attempts int
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to dial the database %s after %d attempt(s): %v", e.Address, e.Attempts, e.Err)
+}
+
+// Cause returns the error of the last attempt.
+func (e *DialError) Cause() error {
+	return e.Err
+}
+
+// GetDBSession dials the session of the config once.
 func GetDBSession(DBConfig config.DBConfig) (*DatabaseSession, error) {
-	// establish mongo db session.
-	mongoDBDialInfo := &mgo.DialInfo{
-		Addrs:    []string{DBConfig.Address},
-		Timeout:  60 * time.Second,
-		Database: DBConfig.Database,
-		Username: DBConfig.UserName,
-		Password: DBConfig.Password,
-	}
-
-	// Create a session which maintains a pool of socket connections
-	// to our MongoDB.
-	mongoSession, err := mgo.DialWithInfo(mongoDBDialInfo)
+	return DialWithRetry(DBConfig, DialOptions{})
+}
+
+// DialWithRetry dials the session of the config, retrying with an exponential backoff.
+func DialWithRetry(DBConfig config.DBConfig, opts DialOptions) (*DatabaseSession, error) {
+	backoff := opts.Backoff
+	for attempt := 1; ; attempt++ {
+		session, err := dial(DBConfig, opts)
+		if err == nil {
+			return session, nil
+		}
+		if attempt > opts.Retries {
+			return nil, &DialError{Address: dialAddress(DBConfig), Attempts: attempt, Err: err}
+		}
+		log.Logf("Database Session Creation ERROR (attempt %d): %s, retrying in %s", attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if opts.MaxBackoff > 0 && backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+// dialAddress describes the hosts of the config for the errors, without the uri credentials.
+func dialAddress(DBConfig config.DBConfig) string {
+	if addrs := DBConfig.Addresses(); len(addrs) > 0 {
+		return strings.Join(addrs, ",")
+	}
+	if DBConfig.URI.IsReference() {
+		return DBConfig.URI.String()
+	}
+	return "(uri)"
+}
+
+// DialDBSession creates the session of the config with the mgo adapter, returning the dial error.
+func DialDBSession(DBConfig config.DBConfig) (*DatabaseSession, error) {
+	return dial(DBConfig, DialOptions{})
+}
+
+func dial(DBConfig config.DBConfig, opts DialOptions) (*DatabaseSession, error) {
+	// the credentials are read once, both drivers take their values
+	if err := DBConfig.ResolveSecrets(); err != nil {
+		return nil, err
+	}
+	DBConfig, err := DBConfig.ApplyURI()
+	if err != nil {
+		return nil, err
+	}
+	clientOptions, err := ClientOptions(DBConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout(DBConfig))
+	defer cancel()
+
+	// the client maintains a pool of connections to every server,
+	// connecting lazily, so the ping surfaces the dial errors
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatalf("Database Session Creation ERROR: %s\n", err)
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	session := &DatabaseSession{client: client, databaseName: DBConfig.Database}
+	if !opts.NoLegacyAdapter {
+		// best effort, mgo can't talk to the servers and users the driver is there for
+		if session.Session, err = dialLegacy(DBConfig); err != nil {
+			log.Logf("The mgo adapter of the database %s is off, the mgo methods of its session are not available: %v",
+				dialAddress(DBConfig), err)
+		}
+	}
+	return session, nil
+}
+
+// ClientOptions returns the driver options of the config, its URI being applied already.
+func ClientOptions(DBConfig config.DBConfig) (*options.ClientOptions, error) {
+	readPref, err := readPreference(DBConfig.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := options.Client()
+	if len(DBConfig.Options) > 0 {
+		// the driver parses the options the config has no field for, e.g. retryWrites or w
+		query := url.Values{}
+		for name, value := range DBConfig.Options {
+			query.Set(name, value)
+		}
+		clientOptions.ApplyURI("mongodb://" + strings.Join(DBConfig.Addresses(), ",") + "/?" + query.Encode())
+		if err := clientOptions.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid database options: %v", err)
+		}
+	}
+	clientOptions.
+		SetHosts(DBConfig.Addresses()).
+		SetConnectTimeout(connectTimeout(DBConfig)).
+		SetReadPreference(readPref)
+	if DBConfig.ReplicaSet != "" {
+		clientOptions.SetReplicaSet(DBConfig.ReplicaSet)
+	}
+	if DBConfig.UserName.IsSet() {
+		username, err := DBConfig.UserName.Read()
+		if err != nil {
+			return nil, fmt.Errorf("username: %v", err)
+		}
+		password, err := DBConfig.Password.Read()
+		if err != nil {
+			return nil, fmt.Errorf("password: %v", err)
+		}
+		clientOptions.SetAuth(options.Credential{
+			AuthMechanism: DBConfig.AuthMechanism,
+			AuthSource:    authSource(DBConfig),
+			Username:      username,
+			Password:      password,
+		})
+	}
+	if DBConfig.TLS != nil {
+		tlsConfig, err := clientTLSConfig(DBConfig.TLS)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	if DBConfig.PoolSize > 0 {
+		clientOptions.SetMaxPoolSize(uint64(DBConfig.PoolSize))
+	}
+	if DBConfig.SocketTimeoutMS > 0 {
+		clientOptions.SetSocketTimeout(time.Duration(DBConfig.SocketTimeoutMS) * time.Millisecond)
+	}
+	return clientOptions, nil
+}
+
+// connectTimeout is 60s unless the config sets it.
+func connectTimeout(DBConfig config.DBConfig) time.Duration {
+	if DBConfig.ConnectTimeoutMS > 0 {
+		return time.Duration(DBConfig.ConnectTimeoutMS) * time.Millisecond
+	}
+	return 60 * time.Second
+}
+
+// authSource is the database of the config unless the config sets it, like mgo did.
+func authSource(DBConfig config.DBConfig) string {
+	if DBConfig.AuthSource != "" {
+		return DBConfig.AuthSource
+	}
+	if DBConfig.Database != "" {
+		return DBConfig.Database
+	}
+	return "admin"
+}
+
+// clientTLSConfig returns the TLS config of the connections to the database.
+func clientTLSConfig(c *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the database CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in the database CA file %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the database client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// readPreference returns the driver read preference, primary when it is empty. The driver has no
+// equivalent of the monotonic mode of mgo, which the mgo session of the adapter keeps.
+func readPreference(readPreference string) (*readpref.ReadPref, error) {
+	switch strings.ToLower(readPreference) {
+	case "", "primary":
+		return readpref.Primary(), nil
+	case "primarypreferred":
+		return readpref.PrimaryPreferred(), nil
+	case "secondary":
+		return readpref.Secondary(), nil
+	case "secondarypreferred":
+		return readpref.SecondaryPreferred(), nil
+	case "nearest":
+		return readpref.Nearest(), nil
 	}
-	mongoSession.SetMode(mgo.Monotonic, true)
-	return &DatabaseSession{mongoSession, DBConfig.Database}, err
+	return nil, fmt.Errorf("unknown read preference %q", readPreference)
 }
@@ -0,0 +1,245 @@
+package mdb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultPageSize is the page size of the requests which don't set it
+	DefaultPageSize = 50
+
+	// MaxPageSize is the largest page returned, larger page sizes are lowered to it
+	MaxPageSize = 1000
+)
+
+// PageRequest is the page of a List call
+type PageRequest struct {
+	PageSize  int32
+	PageToken string
+
+	// Filter is the query of the list, a page token is only valid for the same filter
+	Filter interface{}
+
+	// SortKey is the document field the list is ordered by, "_id" breaking the ties.
+	// The list is ordered by "_id" when it is empty.
+	SortKey    string
+	Descending bool
+}
+
+// Paginator lists the documents of a collection page by page, ordered on a sort key plus _id.
+// Its page tokens are opaque and signed, and refused for another filter or order.
+type Paginator struct {
+	key []byte
+}
+
+// ErrNoPageTokenKey is returned by NewPaginator without key, its tokens could be forged
+var ErrNoPageTokenKey = errors.New("mdb: the page token key is empty")
+
+// NewPaginator returns a paginator signing its page tokens with the key,
+// which must be the same on every replica of the service.
+func NewPaginator(key []byte) (*Paginator, error) {
+	if len(key) == 0 {
+		return nil, ErrNoPageTokenKey
+	}
+	return &Paginator{key: key}, nil
+}
+
+// pageToken is the position of a page, after the last document of the previous one
+type pageToken struct {
+	SortValue interface{} `bson:"v"`
+	ID        interface{} `bson:"i"`
+	Query     string      `bson:"q"`
+}
+
+// Find decodes the documents of the page into results, a pointer to a slice, and
+// returns the token of the next page, empty on the last page. Its errors are gRPC status errors.
+func (p *Paginator) Find(ctx context.Context, coll *mongo.Collection, req PageRequest, results interface{}) (string, error) {
+	nextPageToken, err := p.find(ctx, coll, req, results)
+	return nextPageToken, StatusError(err, coll.Name())
+}
+
+// find is Find returning the database errors as they are.
+func (p *Paginator) find(ctx context.Context, coll *mongo.Collection, req PageRequest, results interface{}) (string, error) {
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return "", fmt.Errorf("mdb: Find results must be a pointer to a slice, got %T", results)
+	}
+	if req.PageSize < 0 {
+		return "", status.Error(codes.InvalidArgument, "page_size must not be negative")
+	}
+	pageSize := int64(req.PageSize)
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	sortKey := req.SortKey
+	if sortKey == "" {
+		sortKey = "_id"
+	}
+	queryHash, err := p.queryHash(req.Filter, sortKey, req.Descending)
+	if err != nil {
+		return "", err
+	}
+
+	filter := orEmpty(req.Filter)
+	if req.PageToken != "" {
+		token, err := p.decode(req.PageToken)
+		if err != nil {
+			return "", err
+		}
+		if !hmac.Equal([]byte(token.Query), []byte(queryHash)) {
+			return "", status.Error(codes.InvalidArgument, "the page token does not match the filter or order of the request")
+		}
+		filter = bson.M{"$and": []interface{}{filter, afterToken(sortKey, req.Descending, token)}}
+	}
+
+	order := 1
+	if req.Descending {
+		order = -1
+	}
+	sort := bson.D{{Key: "_id", Value: order}}
+	if sortKey != "_id" {
+		sort = bson.D{{Key: sortKey, Value: order}, {Key: "_id", Value: order}}
+	}
+
+	// one more document tells whether there is a next page
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(sort).SetLimit(pageSize+1))
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close(ctx)
+
+	items := reflect.MakeSlice(slice.Elem().Type(), 0, int(pageSize))
+	var last bson.Raw
+	for int64(items.Len()) < pageSize && cursor.Next(ctx) {
+		item := reflect.New(slice.Elem().Type().Elem())
+		if err := cursor.Decode(item.Interface()); err != nil {
+			return "", err
+		}
+		items = reflect.Append(items, item.Elem())
+		last = append(last[:0], cursor.Current...)
+	}
+	more := cursor.Next(ctx)
+	if err := cursor.Err(); err != nil {
+		return "", err
+	}
+	slice.Elem().Set(items)
+	if !more || last == nil {
+		return "", nil
+	}
+	return p.encode(last, sortKey, queryHash)
+}
+
+// afterToken is the keyset condition of the documents after the token. The documents
+// without sort key, or with a null one, come first in ascending order as Mongo sorts them.
+func afterToken(sortKey string, descending bool, token pageToken) bson.M {
+	after := "$gt"
+	if descending {
+		after = "$lt"
+	}
+	if sortKey == "_id" {
+		return bson.M{"_id": bson.M{after: token.ID}}
+	}
+	// {sortKey: nil} matches the null and missing sort keys
+	sameKey := bson.M{sortKey: token.SortValue, "_id": bson.M{after: token.ID}}
+	switch {
+	case token.SortValue == nil && descending:
+		return sameKey
+	case token.SortValue == nil:
+		return bson.M{"$or": []interface{}{bson.M{sortKey: bson.M{"$ne": nil}}, sameKey}}
+	case descending:
+		return bson.M{"$or": []interface{}{bson.M{sortKey: bson.M{after: token.SortValue}}, sameKey, bson.M{sortKey: nil}}}
+	}
+	return bson.M{"$or": []interface{}{bson.M{sortKey: bson.M{after: token.SortValue}}, sameKey}}
+}
+
+// queryHash identifies the filter and order of a list, json sorting the map keys.
+func (p *Paginator) queryHash(filter interface{}, sortKey string, descending bool) (string, error) {
+	data, err := json.Marshal([]interface{}{filter, sortKey, descending})
+	if err != nil {
+		return "", fmt.Errorf("mdb: failed to hash the filter: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (p *Paginator) encode(last bson.Raw, sortKey, queryHash string) (string, error) {
+	token := pageToken{Query: queryHash}
+	if err := last.Lookup("_id").Unmarshal(&token.ID); err != nil {
+		return "", fmt.Errorf("mdb: failed to read the _id of the last document: %v", err)
+	}
+	if sortKey != "_id" {
+		// a missing sort key is null, as Mongo sorts it
+		value, err := last.LookupErr(strings.Split(sortKey, ".")...)
+		if err != nil {
+			value = bson.RawValue{Type: bsontype.Null}
+		}
+		if err := value.Unmarshal(&token.SortValue); err != nil {
+			return "", fmt.Errorf("mdb: failed to read the sort key of the last document: %v", err)
+		}
+	}
+	payload, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(p.sign(payload)), nil
+}
+
+func (p *Paginator) decode(encoded string) (pageToken, error) {
+	token := pageToken{}
+	invalid := status.Error(codes.InvalidArgument, "invalid page token")
+
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return token, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return token, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, p.sign(payload)) {
+		return token, invalid
+	}
+	if err := bson.Unmarshal(payload, &token); err != nil {
+		return token, invalid
+	}
+	return token, nil
+}
+
+func (p *Paginator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// ListPage is Paginator.Find on the collection of the repository.
+func (r *Repository) ListPage(ctx context.Context, paginator *Paginator, req PageRequest, results interface{}) (string, error) {
+	coll, err := r.Collection()
+	if err != nil {
+		return "", r.error("list", err)
+	}
+	req.Filter = r.live(ctx, req.Filter)
+	nextPageToken, err := paginator.find(ctx, coll, req, results)
+	if err != nil {
+		return "", r.error("list", err)
+	}
+	return nextPageToken, nil
+}
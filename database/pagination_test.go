@@ -0,0 +1,185 @@
+package mdb
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestPaginator(t *testing.T, key string) *Paginator {
+	t.Helper()
+	p, err := NewPaginator([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testCollection is never connected, the requests tested fail before querying it.
+func testCollection(t *testing.T) *mongo.Collection {
+	t.Helper()
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Database("test").Collection("projects")
+}
+
+func rawDocument(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNewPaginatorWithoutKey(t *testing.T) {
+	if _, err := NewPaginator(nil); err != ErrNoPageTokenKey {
+		t.Fatalf("NewPaginator(nil) = %v, want ErrNoPageTokenKey", err)
+	}
+}
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	p := newTestPaginator(t, "secret")
+	tests := []struct {
+		name    string
+		last    bson.D
+		sortKey string
+		want    pageToken
+	}{
+		{"id", bson.D{{Key: "_id", Value: "p1"}, {Key: "name", Value: "a"}}, "_id", pageToken{ID: "p1", Query: "q"}},
+		{"sort key", bson.D{{Key: "_id", Value: "p1"}, {Key: "rank", Value: int32(3)}}, "rank", pageToken{SortValue: int32(3), ID: "p1", Query: "q"}},
+		{"nested sort key", bson.D{{Key: "_id", Value: int32(7)}, {Key: "owner", Value: bson.D{{Key: "name", Value: "bob"}}}}, "owner.name", pageToken{SortValue: "bob", ID: int32(7), Query: "q"}},
+		{"missing sort key", bson.D{{Key: "_id", Value: "p1"}}, "rank", pageToken{ID: "p1", Query: "q"}},
+		{"null sort key", bson.D{{Key: "_id", Value: "p1"}, {Key: "rank", Value: nil}}, "rank", pageToken{ID: "p1", Query: "q"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := p.encode(rawDocument(t, test.last), test.sortKey, "q")
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := p.decode(encoded)
+			if err != nil {
+				t.Fatalf("decode(%q) failed: %v", encoded, err)
+			}
+			if !reflect.DeepEqual(token, test.want) {
+				t.Errorf("decode(encode()) = %#v, want %#v", token, test.want)
+			}
+		})
+	}
+}
+
+func TestPageTokenTampered(t *testing.T) {
+	p := newTestPaginator(t, "secret")
+	encoded, err := p.encode(rawDocument(t, bson.D{{Key: "_id", Value: "p1"}}), "_id", "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(encoded, ".")
+
+	forged, err := bson.Marshal(pageToken{ID: "p9", Query: "q"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := newTestPaginator(t, "other").encode(rawDocument(t, bson.D{{Key: "_id", Value: "p1"}}), "_id", "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"garbage", "not a token"},
+		{"no signature", parts[0]},
+		{"empty signature", parts[0] + "."},
+		{"extra part", encoded + ".x"},
+		{"invalid base64", parts[0] + ".***"},
+		{"changed payload", base64.RawURLEncoding.EncodeToString(forged) + "." + parts[1]},
+		{"other key", otherKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := p.decode(test.token); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("decode(%q) = %v, want an InvalidArgument error", test.token, err)
+			}
+		})
+	}
+}
+
+func TestPageTokenOfAnotherQuery(t *testing.T) {
+	p := newTestPaginator(t, "secret")
+	first := PageRequest{Filter: bson.M{"status": "ACTIVE"}, SortKey: "rank"}
+	queryHash, err := p.queryHash(first.Filter, first.SortKey, first.Descending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := p.encode(rawDocument(t, bson.D{{Key: "_id", Value: "p1"}, {Key: "rank", Value: int32(3)}}), first.SortKey, queryHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  PageRequest
+	}{
+		{"other filter", PageRequest{Filter: bson.M{"status": "DELETED"}, SortKey: "rank"}},
+		{"no filter", PageRequest{SortKey: "rank"}},
+		{"other sort key", PageRequest{Filter: bson.M{"status": "ACTIVE"}, SortKey: "name"}},
+		{"other order", PageRequest{Filter: bson.M{"status": "ACTIVE"}, SortKey: "rank", Descending: true}},
+	}
+	coll := testCollection(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.req.PageToken = token
+			var results []bson.M
+			if _, err := p.Find(context.Background(), coll, test.req, &results); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("Find() = %v, want an InvalidArgument error", err)
+			}
+		})
+	}
+}
+
+func TestAfterToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		sortKey    string
+		descending bool
+		token      pageToken
+		want       bson.M
+	}{
+		{"id", "_id", false, pageToken{ID: "p1"}, bson.M{"_id": bson.M{"$gt": "p1"}}},
+		{"id descending", "_id", true, pageToken{ID: "p1"}, bson.M{"_id": bson.M{"$lt": "p1"}}},
+		{"sort key", "rank", false, pageToken{SortValue: int32(3), ID: "p1"}, bson.M{"$or": []interface{}{
+			bson.M{"rank": bson.M{"$gt": int32(3)}},
+			bson.M{"rank": int32(3), "_id": bson.M{"$gt": "p1"}},
+		}}},
+		{"sort key descending", "rank", true, pageToken{SortValue: int32(3), ID: "p1"}, bson.M{"$or": []interface{}{
+			bson.M{"rank": bson.M{"$lt": int32(3)}},
+			bson.M{"rank": int32(3), "_id": bson.M{"$lt": "p1"}},
+			bson.M{"rank": nil},
+		}}},
+		{"null sort key", "rank", false, pageToken{ID: "p1"}, bson.M{"$or": []interface{}{
+			bson.M{"rank": bson.M{"$ne": nil}},
+			bson.M{"rank": nil, "_id": bson.M{"$gt": "p1"}},
+		}}},
+		{"null sort key descending", "rank", true, pageToken{ID: "p1"}, bson.M{"rank": nil, "_id": bson.M{"$lt": "p1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := afterToken(test.sortKey, test.descending, test.token); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("afterToken() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
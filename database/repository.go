@@ -0,0 +1,533 @@
+package mdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/lakstap/go-atk/tools"
+	"github.com/micro/go-log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The audit fields written by the repositories
+const (
+	CreatedAtField = "created_at"
+	CreatedByField = "created_by"
+	UpdatedAtField = "updated_at"
+	UpdatedByField = "updated_by"
+	DeletedAtField = "deleted_at"
+)
+
+// SessionFunc returns the current session of a database, e.g. svc.DBSession,
+// so a repository follows the reloads of the database config.
+type SessionFunc func() *DatabaseSession
+
+// Repository runs the common operations on the documents of a collection, by _id.
+// Its errors are gRPC status errors which can be returned by the handlers as is,
+// see StatusError.
+type Repository struct {
+	session    SessionFunc
+	collection string
+
+	// Name of the documents in the error messages, the collection name by default
+	Name string
+
+	// VersionField is the document field holding the version of the documents, e.g. "version".
+	// When set, Create starts the documents at version 1 and every update increments it,
+	// see UpdateIfVersion. The documents are not versioned when it is empty.
+	VersionField string
+
+	// Audit fills the created_* and updated_* fields of the documents, the user being the
+	// one of the User metadata of the request
+	Audit bool
+
+	// SoftDelete makes Delete set deleted_at instead of removing the document. The reads skip
+	// the deleted documents, unless the context is WithDeleted. Purge removes them.
+	SoftDelete bool
+}
+
+// NewRepository returns the repository of the collection, e.g.
+// mdb.NewRepository(svc.DBSession, "projects"), with audit fields and soft deletes.
+func NewRepository(session SessionFunc, collection string) *Repository {
+	return &Repository{session: session, collection: collection, Name: collection, Audit: true, SoftDelete: true}
+}
+
+type withDeletedKey struct{}
+
+// WithDeleted returns a context whose repository reads include the soft deleted documents.
+func WithDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withDeletedKey{}, true)
+}
+
+// Collection returns the collection of the current session, taken anew on every call.
+func (r *Repository) Collection() (*mongo.Collection, error) {
+	session := r.session()
+	if session == nil {
+		return nil, ErrNoSession
+	}
+	return session.Collection(r.collection), nil
+}
+
+// Get decodes the document of the id into result.
+func (r *Repository) Get(ctx context.Context, id interface{}, result interface{}, opts ...*options.FindOneOptions) error {
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("get", err)
+	}
+	err = coll.FindOne(ctx, r.live(ctx, bson.M{"_id": id}), opts...).Decode(result)
+	return r.error("get", err)
+}
+
+// List decodes the documents matching the filter into results, a pointer to a slice.
+func (r *Repository) List(ctx context.Context, filter interface{}, results interface{}, opts ...*options.FindOptions) error {
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return r.error("list", fmt.Errorf("mdb: List results must be a pointer to a slice, got %T", results))
+	}
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("list", err)
+	}
+	cursor, err := coll.Find(ctx, r.live(ctx, filter), opts...)
+	if err != nil {
+		return r.error("list", err)
+	}
+	defer cursor.Close(ctx)
+
+	items := reflect.MakeSlice(slice.Elem().Type(), 0, 0)
+	for cursor.Next(ctx) {
+		item := reflect.New(slice.Elem().Type().Elem())
+		if err := cursor.Decode(item.Interface()); err != nil {
+			return r.error("list", err)
+		}
+		items = reflect.Append(items, item.Elem())
+	}
+	if err := cursor.Err(); err != nil {
+		return r.error("list", err)
+	}
+	slice.Elem().Set(items)
+	return nil
+}
+
+// Count returns the number of documents matching the filter.
+func (r *Repository) Count(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	coll, err := r.Collection()
+	if err != nil {
+		return 0, r.error("count", err)
+	}
+	count, err := coll.CountDocuments(ctx, r.live(ctx, filter), opts...)
+	return count, r.error("count", err)
+}
+
+// Create inserts the document and returns its id, AlreadyExists when the id or
+// another unique key is taken.
+func (r *Repository) Create(ctx context.Context, doc interface{}) (interface{}, error) {
+	coll, err := r.Collection()
+	if err != nil {
+		return nil, r.error("create", err)
+	}
+	if doc, err = r.prepareCreate(ctx, doc); err != nil {
+		return nil, r.error("create", err)
+	}
+	result, err := coll.InsertOne(ctx, doc)
+	if err != nil {
+		return nil, r.error("create", err)
+	}
+	return result.InsertedID, nil
+}
+
+// Update applies the update document, e.g. bson.M{"$set": ...}, to the document of the id,
+// NotFound when there is no such document.
+func (r *Repository) Update(ctx context.Context, id interface{}, update interface{}) error {
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("update", err)
+	}
+	if update, err = r.prepareUpdate(ctx, update); err != nil {
+		return r.error("update", err)
+	}
+	result, err := coll.UpdateOne(ctx, r.live(ctx, bson.M{"_id": id}), update)
+	if err != nil {
+		return r.error("update", err)
+	}
+	if result.MatchedCount == 0 {
+		return r.error("update", mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+// UpdateIfVersion applies the update to the document of the id when it is at the version,
+// e.g. the one of tools.IfMatchVersion, and returns its new version. It fails with Aborted
+// when the document was changed since, NotFound when there is no such document.
+func (r *Repository) UpdateIfVersion(ctx context.Context, id interface{}, version int64, update interface{}) (int64, error) {
+	coll, err := r.Collection()
+	if err != nil {
+		return 0, r.error("update", err)
+	}
+	if r.VersionField == "" {
+		return 0, r.error("update", status.Error(codes.FailedPrecondition, r.Name+" are not versioned"))
+	}
+	if update, err = r.prepareUpdate(ctx, update); err != nil {
+		return 0, r.error("update", err)
+	}
+	result, err := coll.UpdateOne(ctx, r.live(ctx, bson.M{"_id": id, r.VersionField: version}), update)
+	if err != nil {
+		return 0, r.error("update", err)
+	}
+	if result.MatchedCount == 0 {
+		return 0, r.error("update", r.versionMismatch(ctx, coll, id))
+	}
+	return version + 1, nil
+}
+
+// upsertAttempts bounds the reads and replacements of Upsert when the document changes in between
+const upsertAttempts = 3
+
+// Upsert replaces the document of the id, inserting it when there is none, and reports whether
+// it was inserted. The replacement keeps the created_* fields of the document, increments its
+// version, if any, and is no longer deleted.
+func (r *Repository) Upsert(ctx context.Context, id interface{}, doc interface{}) (bool, error) {
+	coll, err := r.Collection()
+	if err != nil {
+		return false, r.error("upsert", err)
+	}
+	for attempt := 1; ; attempt++ {
+		inserted, retry, err := r.upsert(ctx, coll, id, doc)
+		if !retry || attempt == upsertAttempts {
+			return inserted, r.error("upsert", err)
+		}
+	}
+}
+
+// upsert reads the fields kept from the current document and replaces it, provided it wasn't changed
+// in between, or inserts the document. retry reports whether the document changed in between.
+func (r *Repository) upsert(ctx context.Context, coll *mongo.Collection, id interface{}, doc interface{}) (inserted, retry bool, err error) {
+	projection := bson.M{"_id": 1}
+	if r.Audit {
+		projection[CreatedAtField] = 1
+		projection[CreatedByField] = 1
+	}
+	if r.VersionField != "" {
+		projection[r.VersionField] = 1
+	}
+	current := bson.M{}
+	err = coll.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(projection)).Decode(&current)
+	if isError(err, mongo.ErrNoDocuments) {
+		if doc, err = r.prepareCreate(ctx, doc); err != nil {
+			return false, false, err
+		}
+		if doc, err = withFields(doc, bson.D{{Key: "_id", Value: id}}); err != nil {
+			return false, false, err
+		}
+		if _, err = coll.InsertOne(ctx, doc); err != nil {
+			// inserted by another request in between, or another unique key is taken
+			return false, IsDuplicateKey(err), err
+		}
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	filter := bson.M{"_id": id}
+	var fields bson.D
+	if r.Audit {
+		for _, field := range []string{CreatedAtField, CreatedByField} {
+			if value, ok := current[field]; ok {
+				fields = append(fields, bson.E{Key: field, Value: value})
+			}
+		}
+		fields = append(fields, r.auditFields(ctx, UpdatedAtField, UpdatedByField)...)
+	}
+	if r.VersionField != "" {
+		version, err := versionNumber(current[r.VersionField])
+		if err != nil {
+			return false, false, fmt.Errorf("mdb: invalid version of the %s %v: %v", r.Name, id, err)
+		}
+		filter[r.VersionField] = current[r.VersionField]
+		fields = append(fields, bson.E{Key: r.VersionField, Value: version + 1})
+	}
+	replacement, err := withFields(doc, fields)
+	if err != nil {
+		return false, false, err
+	}
+	if r.SoftDelete {
+		replacement = withoutField(replacement, DeletedAtField)
+	}
+	result, err := coll.ReplaceOne(ctx, filter, replacement)
+	if err != nil {
+		return false, false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, true, status.Errorf(codes.Aborted, "the %s was modified concurrently, try again", r.Name)
+	}
+	return false, false, nil
+}
+
+// versionNumber returns the version of a document, 0 when it has none.
+func versionNumber(version interface{}) (int64, error) {
+	switch v := version.(type) {
+	case nil:
+		return 0, nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", version)
+}
+
+// Delete removes the document of the id, or marks it deleted with SoftDelete,
+// NotFound when there is no such document.
+func (r *Repository) Delete(ctx context.Context, id interface{}) error {
+	return r.delete(ctx, bson.M{"_id": id}, func(coll *mongo.Collection) error {
+		return mongo.ErrNoDocuments
+	})
+}
+
+// DeleteIfVersion removes the document of the id, or marks it deleted with SoftDelete, when it is
+// at the version. It fails with Aborted when the document was changed since, NotFound when there is
+// no such document.
+func (r *Repository) DeleteIfVersion(ctx context.Context, id interface{}, version int64) error {
+	if r.VersionField == "" {
+		return r.error("delete", status.Error(codes.FailedPrecondition, r.Name+" are not versioned"))
+	}
+	return r.delete(ctx, bson.M{"_id": id, r.VersionField: version}, func(coll *mongo.Collection) error {
+		return r.versionMismatch(ctx, coll, id)
+	})
+}
+
+func (r *Repository) delete(ctx context.Context, filter bson.M, notFound func(*mongo.Collection) error) error {
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("delete", err)
+	}
+	var deleted int64
+	if r.SoftDelete {
+		update, err := r.prepareUpdate(ctx, bson.M{"$set": bson.M{DeletedAtField: time.Now()}})
+		if err != nil {
+			return r.error("delete", err)
+		}
+		filter[DeletedAtField] = nil
+		result, err := coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return r.error("delete", err)
+		}
+		deleted = result.MatchedCount
+	} else {
+		result, err := coll.DeleteOne(ctx, filter)
+		if err != nil {
+			return r.error("delete", err)
+		}
+		deleted = result.DeletedCount
+	}
+	if deleted == 0 {
+		return r.error("delete", notFound(coll))
+	}
+	return nil
+}
+
+// Purge removes the document of the id for good, deleted or not, NotFound when there is no such document.
+func (r *Repository) Purge(ctx context.Context, id interface{}) error {
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("purge", err)
+	}
+	result, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return r.error("purge", err)
+	}
+	if result.DeletedCount == 0 {
+		return r.error("purge", mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+// Restore undeletes the soft deleted document of the id, NotFound when there is no such deleted document.
+func (r *Repository) Restore(ctx context.Context, id interface{}) error {
+	coll, err := r.Collection()
+	if err != nil {
+		return r.error("restore", err)
+	}
+	update, err := r.prepareUpdate(ctx, bson.M{"$unset": bson.M{DeletedAtField: ""}})
+	if err != nil {
+		return r.error("restore", err)
+	}
+	result, err := coll.UpdateOne(ctx, bson.M{"_id": id, DeletedAtField: bson.M{"$ne": nil}}, update)
+	if err != nil {
+		return r.error("restore", err)
+	}
+	if result.MatchedCount == 0 {
+		return r.error("restore", mongo.ErrNoDocuments)
+	}
+	return nil
+}
+
+// versionMismatch tells why no document of the id was at the expected version.
+func (r *Repository) versionMismatch(ctx context.Context, coll *mongo.Collection, id interface{}) error {
+	count, err := coll.CountDocuments(ctx, r.live(ctx, bson.M{"_id": id}), options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return status.Errorf(codes.Aborted, "the %s was modified concurrently, read it again", r.Name)
+}
+
+// live restricts the filter to the documents which are not deleted, unless the context is WithDeleted.
+func (r *Repository) live(ctx context.Context, filter interface{}) interface{} {
+	if !r.SoftDelete {
+		return orEmpty(filter)
+	}
+	if withDeleted, _ := ctx.Value(withDeletedKey{}).(bool); withDeleted {
+		return orEmpty(filter)
+	}
+	notDeleted := bson.M{DeletedAtField: nil}
+	if filter == nil {
+		return notDeleted
+	}
+	return bson.M{"$and": []interface{}{filter, notDeleted}}
+}
+
+// auditFields returns the time and user of the request as the given fields, the user
+// being left out when the request has none.
+func (r *Repository) auditFields(ctx context.Context, atField, byField string) bson.D {
+	fields := bson.D{{Key: atField, Value: time.Now()}}
+	if uid, _ := tools.GetUIDFromContext(ctx); uid != "" {
+		fields = append(fields, bson.E{Key: byField, Value: uid})
+	}
+	return fields
+}
+
+// prepareCreate adds the audit fields and the first version to the document.
+func (r *Repository) prepareCreate(ctx context.Context, doc interface{}) (interface{}, error) {
+	var fields bson.D
+	if r.Audit {
+		fields = append(fields, r.auditFields(ctx, CreatedAtField, CreatedByField)...)
+		fields = append(fields, r.auditFields(ctx, UpdatedAtField, UpdatedByField)...)
+	}
+	if r.VersionField != "" {
+		fields = append(fields, bson.E{Key: r.VersionField, Value: int64(1)})
+	}
+	if len(fields) == 0 {
+		return doc, nil
+	}
+	return withFields(doc, fields)
+}
+
+// prepareUpdate adds the updated_* fields and the increment of the version to the update document.
+func (r *Repository) prepareUpdate(ctx context.Context, update interface{}) (interface{}, error) {
+	if !r.Audit && r.VersionField == "" {
+		return update, nil
+	}
+	doc, err := toDocument(update)
+	if err != nil {
+		return nil, err
+	}
+	if r.Audit {
+		if doc, err = withOperatorFields(doc, "$set", r.auditFields(ctx, UpdatedAtField, UpdatedByField)); err != nil {
+			return nil, fmt.Errorf("mdb: invalid update of %s: %v", r.Name, err)
+		}
+	}
+	if r.VersionField != "" {
+		if doc, err = withOperatorFields(doc, "$inc", bson.D{{Key: r.VersionField, Value: int64(1)}}); err != nil {
+			return nil, fmt.Errorf("mdb: invalid update of %s: %v", r.Name, err)
+		}
+	}
+	return doc, nil
+}
+
+// withOperatorFields sets the fields in the operator of the update document, e.g. "$set".
+func withOperatorFields(update bson.D, operator string, fields bson.D) (bson.D, error) {
+	for i, e := range update {
+		if e.Key != operator {
+			continue
+		}
+		operands, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a document", operator)
+		}
+		update[i].Value = setFields(operands, fields)
+		return update, nil
+	}
+	return append(update, bson.E{Key: operator, Value: fields}), nil
+}
+
+// withFields returns the document with the fields set.
+func withFields(doc interface{}, fields bson.D) (bson.D, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	return setFields(d, fields), nil
+}
+
+// withoutField returns the document without the field.
+func withoutField(doc bson.D, field string) bson.D {
+	kept := doc[:0]
+	for _, e := range doc {
+		if e.Key != field {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+func setFields(doc bson.D, fields bson.D) bson.D {
+	for _, field := range fields {
+		found := false
+		for i, e := range doc {
+			if e.Key == field.Key {
+				doc[i].Value = field.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			doc = append(doc, field)
+		}
+	}
+	return doc
+}
+
+// toDocument turns a struct or map into an ordered document, the nested documents too.
+func toDocument(doc interface{}) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{}
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// error logs the internal errors, which are not sent to the client, and maps them to a status.
+// The transient transaction errors are returned as is for WithTransaction to retry.
+func (r *Repository) error(op string, err error) error {
+	if IsTransientTransactionError(err) {
+		return err
+	}
+	statusErr := StatusError(err, r.Name)
+	if code := status.Code(statusErr); code == codes.Internal || code == codes.Unavailable {
+		log.Logf("Failed to %s %s: %v", op, r.Name, err)
+	}
+	return statusErr
+}
+
+func orEmpty(filter interface{}) interface{} {
+	if filter == nil {
+		return bson.D{}
+	}
+	return filter
+}
@@ -0,0 +1,76 @@
+package mdb
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TransactionRetryTimeout bounds the retries of a transaction, as the drivers do
+var TransactionRetryTimeout = 2 * time.Minute
+
+// WithTransaction runs fn in a transaction, committed when fn succeeds and aborted when it fails.
+// The operations of fn join the transaction when they are given txCtx, the repository calls too as
+// long as their session is this one. Needs a replica set.
+//
+// The transaction is run again on the transient errors, e.g. a write conflict, and the commit
+// retried when its result is unknown, for TransactionRetryTimeout. fn must be safe to run again.
+// The errors of fn are returned as they are, the transactions which keep failing as Aborted.
+func (s *DatabaseSession) WithTransaction(ctx context.Context, fn func(txCtx context.Context) error, opts ...*options.TransactionOptions) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return StatusError(err, "transaction")
+	}
+	defer session.EndSession(context.Background())
+
+	deadline := time.Now().Add(TransactionRetryTimeout)
+	return mongo.WithSession(ctx, session, func(txCtx mongo.SessionContext) error {
+		for {
+			if err := txCtx.StartTransaction(opts...); err != nil {
+				return StatusError(err, "transaction")
+			}
+			if err := fn(txCtx); err != nil {
+				// aborting does not fail on the client, the server aborts on its own otherwise
+				txCtx.AbortTransaction(txCtx)
+				if IsTransientTransactionError(err) && time.Now().Before(deadline) && ctx.Err() == nil {
+					continue
+				}
+				if IsTransientTransactionError(err) {
+					return transactionError(err)
+				}
+				return err
+			}
+
+			err := commit(txCtx, deadline)
+			if err == nil {
+				return nil
+			}
+			if IsTransientTransactionError(err) && time.Now().Before(deadline) && ctx.Err() == nil {
+				continue
+			}
+			return transactionError(err)
+		}
+	})
+}
+
+// commit commits the transaction, again while its result is unknown.
+func commit(txCtx mongo.SessionContext, deadline time.Time) error {
+	for {
+		err := txCtx.CommitTransaction(txCtx)
+		if err == nil || !hasErrorLabel(err, "UnknownTransactionCommitResult") ||
+			!time.Now().Before(deadline) || txCtx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func transactionError(err error) error {
+	if IsTransientTransactionError(err) || hasErrorLabel(err, "UnknownTransactionCommitResult") {
+		return status.Error(codes.Aborted, "the transaction failed, retry it")
+	}
+	return StatusError(err, "transaction")
+}
@@ -0,0 +1,40 @@
+package atk
+
+import (
+	"flag"
+	"strings"
+)
+
+// GatewayFlags are the command line flags of the gateway settings.
+type GatewayFlags struct {
+	Port        *string
+	Endpoint    *string
+	Network     *string
+	Environment *string
+	SwaggerDir  *string
+}
+
+// BindGatewayFlags defines the gateway flags on the flag set,
+// use flag.CommandLine for the flags of the process.
+func BindGatewayFlags(fs *flag.FlagSet) *GatewayFlags {
+	return &GatewayFlags{
+		// the go.micro.srv.atk address
+		Port:        fs.String("port", defaultPort, "go.micro.srv.atk.project address"),
+		Endpoint:    fs.String("endpoint", defaultEndpoint, "go.micro.srv.atk.project endpoint"),
+		Network:     fs.String("network", defaultNetwork, `one of "tcp" or "unix". Must be consistent to -network`),
+		Environment: fs.String("environment", defaultEnvironment, `identify which environment application is running`),
+		SwaggerDir:  fs.String("swagger_dir", defaultSwaggerDir, "path to the directory which contains swagger definitions"),
+	}
+}
+
+// WithGatewayFlags applies the parsed flag values to the gateway,
+// options given after it override them.
+func WithGatewayFlags(flags *GatewayFlags) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Addr = *flags.Port
+		gwOption.Endpoints = strings.Split(*flags.Endpoint, ",")
+		gwOption.Network = *flags.Network
+		gwOption.Env = *flags.Environment
+		gwOption.SwaggerDir = *flags.SwaggerDir
+	}
+}
@@ -1,7 +1,7 @@
 package atk
 
 import (
-	"flag"
+	"expvar"
 	"google.golang.org/grpc"
 	"github.com/golang/glog"
 	"net/http"
@@ -12,17 +12,21 @@ import (
 	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/go-log/log"
 	"github.com/lakstap/go-atk/gateway"
+	atkconfig "github.com/lakstap/go-atk/config"
+	"github.com/lakstap/go-atk/database"
+	dbconfig "github.com/lakstap/go-atk/database/config"
+	"github.com/micro/go-micro/registry"
 	"strings"
 	"reflect"
 )
 
-var (
+const (
 	// the go.micro.srv.atk address
-	port        = flag.String("port", ":8090", "go.micro.srv.atk.project address")
-	endpoint    = flag.String("endpoint", "0.0.0.0:9090", "go.micro.srv.atk.project endpoint")
-	network     = flag.String("network", "tcp", `one of "tcp" or "unix". Must be consistent to -network`)
-	environment = flag.String("environment", "dev", `identify which environment application is running`)
-	swaggerDir  = flag.String("swagger_dir", "proto/api", "path to the directory which contains swagger definitions")
+	defaultPort        = ":8090"
+	defaultEndpoint    = "0.0.0.0:9090"
+	defaultNetwork     = "tcp"
+	defaultEnvironment = "dev"
+	defaultSwaggerDir  = "proto/api"
 )
 
 // Endpoint describes a gRPC endpoint
@@ -35,6 +39,10 @@ type ATKGateway struct {
 	// Addr is the address to listen
 	Addr string
 
+	// AdminAddr is the address of the admin listener serving /debug/vars, off when empty.
+	// It has no auth, keep it on a private interface, e.g. "127.0.0.1:8091".
+	AdminAddr string
+
 	// Environment
 	Env string
 
@@ -42,11 +50,59 @@ type ATKGateway struct {
 	// serves swagger specs.
 	SwaggerDir string
 
+	// Endpoints are the static backend addresses, by endpoint handler index
+	Endpoints []string
+
+	// Network is one of "tcp" or "unix", the network of the static endpoints
+	Network string
+
+	// Auth configures the verification of the bearer tokens
+	Auth gateway.AuthConfig
+
+	// AuthPaths are the URL path prefixes requiring a bearer token
+	AuthPaths []string
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when set
+	TLSCertFile string
+	TLSKeyFile  string
+
 	// Mux is a list of options to be passed to the grpc-gateway multiplexer
 	EndpointHandlers []EndpointHandler
 
+	// Backends describes the backend of each endpoint handler, by index
+	Backends []gateway.Backend
+
+	// Registry resolves the backends addressed by micro service name
+	Registry registry.Registry
+
 	// Mux is a list of options to be passed to the grpc-gateway multiplexer
 	Mux []gwruntime.ServeMuxOption
+
+	// Headers controls the HTTP headers forwarded to and returned from the services
+	Headers gateway.HeaderConfig
+
+	// RateLimit enables rate limiting of the requests when set
+	RateLimit *gateway.RateLimitConfig
+
+	// RateLimitStore keeps the rate limit counters, in memory by default
+	RateLimitStore gateway.RateLimitStore
+
+	// Resilience holds the deadline, retry and circuit breaker policies of the backends
+	Resilience gateway.ResilienceConfig
+
+	// BackendTLS dials the backends without TLS settings of their own over TLS
+	BackendTLS *gateway.TLSConfig
+
+	// CORS restricts the cross origin requests, every origin is allowed when nil
+	CORS *gateway.CORSConfig
+
+	// backendConfigs are the backend settings of the ATK config, see WithConfig
+	backendConfigs []atkconfig.BackendConfig
+
+	// rateLimitDB is the database of the mongo rate limit store of the ATK config,
+	// dialed by RunGateway unless RateLimitStore is set
+	rateLimitDB         *dbconfig.DBConfig
+	rateLimitCollection string
 }
 
 type EndpointHandlerOption func(*ATKGateway)
@@ -57,6 +113,126 @@ type EndpointHandler func(context.Context, *gwruntime.ServeMux, string, []grpc.D
 func WithEndpointHandlerOption(handler EndpointHandler) EndpointHandlerOption {
 	return func(gwOption *ATKGateway) {
 		gwOption.EndpointHandlers = append(gwOption.EndpointHandlers, handler)
+		gwOption.Backends = append(gwOption.Backends, gateway.Backend{})
+	}
+}
+
+// WithServiceEndpointHandler registers a handler whose backend is resolved from
+// the registry by its micro service name, e.g. "go.micro.srv.atk.project".
+func WithServiceEndpointHandler(service string, handler EndpointHandler) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.EndpointHandlers = append(gwOption.EndpointHandlers, handler)
+		gwOption.Backends = append(gwOption.Backends, gateway.Backend{Service: service})
+	}
+}
+
+// WithBackendEndpointHandler registers a handler together with the addresses,
+// load balancing and connection settings of its backend.
+func WithBackendEndpointHandler(backend gateway.Backend, handler EndpointHandler) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.EndpointHandlers = append(gwOption.EndpointHandlers, handler)
+		gwOption.Backends = append(gwOption.Backends, backend)
+	}
+}
+
+// WithBackendTLS dials the backends without TLS settings of their own over TLS.
+func WithBackendTLS(tls gateway.TLSConfig) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.BackendTLS = &tls
+	}
+}
+
+// WithCORS allows the cross origin requests of the config only.
+func WithCORS(cors gateway.CORSConfig) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.CORS = &cors
+	}
+}
+
+// WithRegistry sets the registry the backends are resolved from.
+func WithRegistry(reg registry.Registry) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Registry = reg
+	}
+}
+
+// WithHeaderConfig replaces the default header forwarding rules of the gateway.
+func WithHeaderConfig(headers gateway.HeaderConfig) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Headers = headers
+	}
+}
+
+// WithRateLimit limits the requests per user, API key or client IP.
+// A nil store keeps the limits in the memory of this gateway replica.
+func WithRateLimit(limits gateway.RateLimitConfig, store gateway.RateLimitStore) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.RateLimit = &limits
+		gwOption.RateLimitStore = store
+	}
+}
+
+// WithBackendPolicy sets the deadline, retry and circuit breaker policy of a backend,
+// identified by its fully qualified gRPC service name.
+func WithBackendPolicy(service string, policy gateway.BackendPolicy) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		if gwOption.Resilience.Backends == nil {
+			gwOption.Resilience.Backends = make(map[string]gateway.BackendPolicy)
+		}
+		gwOption.Resilience.Backends[service] = policy
+	}
+}
+
+// WithAddr sets the address the gateway listens on.
+func WithAddr(addr string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Addr = addr
+	}
+}
+
+// WithAdminAddr serves the metrics of /debug/vars on a separate listener.
+func WithAdminAddr(addr string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.AdminAddr = addr
+	}
+}
+
+// WithEnv sets the environment the gateway is running in.
+func WithEnv(env string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Env = env
+	}
+}
+
+// WithSwaggerDir sets the directory the swagger definitions are served from.
+func WithSwaggerDir(dir string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.SwaggerDir = dir
+	}
+}
+
+// WithEndpoints sets the static backend addresses, by endpoint handler index,
+// on the given network ("tcp" or "unix").
+func WithEndpoints(network string, endpoints ...string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Network = network
+		gwOption.Endpoints = endpoints
+	}
+}
+
+// WithAuth requires a bearer token verified against the auth config on the path prefixes.
+func WithAuth(auth gateway.AuthConfig, paths ...string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.Auth = auth
+		gwOption.AuthPaths = paths
+	}
+}
+
+// WithTLS serves HTTPS with the given certificate and key files.
+func WithTLS(certFile, keyFile string) EndpointHandlerOption {
+	return func(gwOption *ATKGateway) {
+		gwOption.TLSCertFile = certFile
+		gwOption.TLSKeyFile = keyFile
 	}
 }
 
@@ -65,34 +241,61 @@ func NewATKGateway(opts ...EndpointHandlerOption) *ATKGateway {
 
 	atkGateway := &ATKGateway{
 		EndpointHandlers: make([]EndpointHandler, 0),
-		Addr:             *port,
-		SwaggerDir:       *swaggerDir,
-		Env:              *environment,
+		Backends:         make([]gateway.Backend, 0),
+		Registry:         registry.DefaultRegistry,
+		Addr:             defaultPort,
+		SwaggerDir:       defaultSwaggerDir,
+		Env:              defaultEnvironment,
+		Endpoints:        []string{defaultEndpoint},
+		Network:          defaultNetwork,
+		Auth:             gateway.AuthConfig{InsecureSkipVerify: true},
+		Headers:          gateway.DefaultHeaderConfig,
+		Resilience:       gateway.ResilienceConfig{Default: gateway.DefaultBackendPolicy},
 	}
 
 	for _, opt := range opts {
 		opt(atkGateway)
 	}
+	atkGateway.applyBackendConfigs()
 	return atkGateway
 }
 
 // Run starts a HTTP server and blocks while running if successful.
 // The server will be shutdown when "ctx" is canceled.
+// The options are kept for compatibility, use WithAuth and WithTLS instead:
+// an auth enabled flag, the ":" separated auth paths and a HTTPS enabled flag.
 func (gw *ATKGateway) RunGateway(ctx context.Context, options ...interface{}) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	gw.applyRunOptions(options)
+	if err := gw.checkProduction(); err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/swagger.json", gateway.ServeSwaggerJSON(gw.SwaggerDir))
-	gwy, err := newGateway(ctx, gw.EndpointHandlers, gw.Mux)
+	gwy, err := newGateway(ctx, gw)
 	if err != nil {
 		return err
 	}
-	if len(options) > 0 && options[0] == true {
-		urls := strings.Split(reflect.ValueOf(options[1]).String(), ":")
-		for _, url := range urls {
-			mux.Handle("/"+url+"/", gateway.AuthMiddleware(ctx, gwy))
+	gwy = gateway.EventStreamMiddleware(gwy)
+	if gw.RateLimit != nil {
+		store := gw.RateLimitStore
+		if store == nil && gw.rateLimitDB != nil {
+			session, err := mdb.DialDBSession(*gw.rateLimitDB)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+			if store, err = gateway.NewMongoRateLimitStore(session, gw.rateLimitCollection); err != nil {
+				return err
+			}
 		}
+		gwy = gateway.RateLimitMiddleware(*gw.RateLimit, store, gwy)
+	}
+	for _, path := range gw.authPaths() {
+		mux.Handle("/"+path+"/", gateway.NewAuthMiddleware(ctx, gw.Auth, gwy))
 	}
 
 	//mux.Handle("/health/", gateway.DefaultAuthMiddleware(ctx, gwy))
@@ -100,9 +303,17 @@ func (gw *ATKGateway) RunGateway(ctx context.Context, options ...interface{}) er
 
 	gateway.SwaggerServer(mux)
 
+	handler := gateway.SetupGlobalMiddleware(mux)
+	if gw.CORS != nil {
+		handler = gateway.SetupCORSMiddleware(*gw.CORS, mux)
+	}
 	s := &http.Server{
 		Addr:    gw.Addr,
-		Handler: gateway.SetupGlobalMiddleware(mux),
+		Handler: handler,
+	}
+
+	if gw.AdminAddr != "" {
+		gw.runAdmin(ctx)
 	}
 
 	go func() {
@@ -112,13 +323,10 @@ func (gw *ATKGateway) RunGateway(ctx context.Context, options ...interface{}) er
 			glog.Errorf("Failed to shutdown http server: %v", err)
 		}
 	}()
-	isHTTPSEnabled := false;
-	if len(options) > 0 && options[2] == true {
-		isHTTPSEnabled = reflect.ValueOf(options[2]).Bool()
-	}
-	log.Logf("Server Started  listening at the address at %s is HTTPS Enable (%s)", gw.Addr, isHTTPSEnabled)
+	isHTTPSEnabled := gw.TLSCertFile != "" && gw.TLSKeyFile != ""
+	log.Logf("Server Started  listening at the address at %s is HTTPS Enable (%v)", gw.Addr, isHTTPSEnabled)
 	if isHTTPSEnabled {
-		if err := s.ListenAndServeTLS("/etc/secrets/server.crt", "/etc/secrets/server.key"); err != http.ErrServerClosed {
+		if err := s.ListenAndServeTLS(gw.TLSCertFile, gw.TLSKeyFile); err != http.ErrServerClosed {
 			glog.Errorf("Failed to listen and serve: %v", err)
 			return err
 		}
@@ -131,24 +339,126 @@ func (gw *ATKGateway) RunGateway(ctx context.Context, options ...interface{}) er
 	return nil
 }
 
+// runAdmin serves the expvar metrics on the admin address until ctx is done.
+func (gw *ATKGateway) runAdmin(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s := &http.Server{
+		Addr:    gw.AdminAddr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		if err := s.Shutdown(context.Background()); err != nil {
+			glog.Errorf("Failed to shutdown the admin server: %v", err)
+		}
+	}()
+	go func() {
+		log.Logf("Admin server listening at the address %s", gw.AdminAddr)
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			glog.Errorf("Failed to listen and serve the admin server: %v", err)
+		}
+	}()
+}
+
+// applyRunOptions maps the legacy RunGateway options onto the gateway settings.
+func (gw *ATKGateway) applyRunOptions(options []interface{}) {
+	if len(options) > 1 && options[0] == true {
+		gw.AuthPaths = strings.Split(reflect.ValueOf(options[1]).String(), ":")
+	}
+	if len(options) > 2 && options[2] == true {
+		gw.TLSCertFile = "/etc/secrets/server.crt"
+		gw.TLSKeyFile = "/etc/secrets/server.key"
+	}
+}
+
+// authPaths returns the auth path prefixes without their slashes, skipping the empty ones.
+func (gw *ATKGateway) authPaths() []string {
+	var paths []string
+	for _, path := range gw.AuthPaths {
+		if path = strings.Trim(path, "/"); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// checkProduction refuses to run a production gateway with insecure settings,
+// the rules are the ones of the config CheckProduction.
+func (gw *ATKGateway) checkProduction() error {
+	cfg := gw.productionConfig()
+	if !cfg.IsProduction() {
+		return nil
+	}
+	if err := cfg.CheckProduction(); err != nil {
+		return fmt.Errorf("refusing to run the %s gateway with insecure settings: %v", gw.Env, err)
+	}
+	return nil
+}
+
+// productionConfig returns the settings of the gateway checked by CheckProduction,
+// whether they come from the ATK config or from the options.
+func (gw *ATKGateway) productionConfig() *atkconfig.ATKConfig {
+	cfg := &atkconfig.ATKConfig{Environment: gw.Env}
+	cfg.Auth.Paths = gw.authPaths()
+	cfg.Auth.Enabled = len(cfg.Auth.Paths) > 0
+	cfg.Auth.InsecureSkipVerify = gw.Auth.InsecureSkipVerify
+	if gw.CORS != nil {
+		cfg.Gateway.CORS.AllowedOrigins = gw.CORS.AllowedOrigins
+	}
+	cfg.Gateway.BackendTLS = toConfigTLS(gw.BackendTLS)
+	for i, backend := range gw.Backends {
+		name := backend.Service
+		if name == "" {
+			name = fmt.Sprintf("of the endpoint handler %d", i)
+		}
+		cfg.Backends = append(cfg.Backends, atkconfig.BackendConfig{Service: name, TLS: toConfigTLS(backend.TLS)})
+	}
+	return cfg
+}
+
 // newGateway returns a  gateway server which translates HTTP into gRPC.
-func newGateway(ctx context.Context, handlers []EndpointHandler, opts []gwruntime.ServeMuxOption) (http.Handler, error) {
+func newGateway(ctx context.Context, gw *ATKGateway) (http.Handler, error) {
+	// no proto error handler: grpc-gateway v1.9 sets the package HTTPError and
+	// OtherErrorHandler from it, the If-Match failures are mapped by PreconditionMiddleware
+	opts := append([]gwruntime.ServeMuxOption{}, gw.Mux...)
 	opts = append(opts, gwruntime.WithMetadata(gateway.ForwardAuthenticationMetadata))
+	opts = append(opts, gwruntime.WithMetadata(gw.Headers.ForwardClientIPMetadata))
+	opts = append(opts, gwruntime.WithIncomingHeaderMatcher(gw.Headers.IncomingHeaderMatcher()))
+	opts = append(opts, gwruntime.WithOutgoingHeaderMatcher(gw.Headers.OutgoingHeaderMatcher()))
 	opts = append(opts, gwruntime.WithMarshalerOption(gwruntime.MIMEWildcard, &gwruntime.JSONPb{OrigName: true, EmitDefaults: true}))
 	mux := gwruntime.NewServeMux(opts...)
-	dialopts := []grpc.DialOption{grpc.WithInsecure(), gateway.WithClientUnaryInterceptor(*environment)}
+	dialopts := []grpc.DialOption{gateway.WithClientUnaryInterceptor(gw.Env, gateway.PreconditionInterceptor, gateway.ResilienceInterceptor(gw.Resilience))}
 
-	endpoints := strings.Split(*endpoint, ",")
+	endpoints := gw.Endpoints
+	registryScheme := gateway.RegisterRegistryResolver(gw.Registry)
 
-	for i, f := range handlers {
-		if err := f(ctx, mux, endpoints[i], dialopts); err != nil {
+	for i, f := range gw.EndpointHandlers {
+		backend := gateway.Backend{}
+		if i < len(gw.Backends) {
+			backend = gw.Backends[i]
+		}
+		staticEndpoint := ""
+		if i < len(endpoints) {
+			staticEndpoint = endpoints[i]
+		}
+		target := backend.Target(registryScheme, staticEndpoint)
+		backendDialopts, err := backend.DialOptions(gw.BackendTLS)
+		if err != nil {
+			return nil, err
+		}
+		backendopts := append(dialopts, backendDialopts...)
+		if target == staticEndpoint && gw.Network == "unix" {
+			backendopts = append(backendopts, grpc.WithDialer(dialUnixSocket))
+		}
+		if err := f(ctx, mux, target, backendopts); err != nil {
 			//if err := f(ctx, mux, conn); err != nil {
-			fmt.Println("ERR: Failed to getting connect end point")
+			fmt.Println("ERR: Failed to getting connect end point", target)
 			return nil, err
 		}
 	}
 
-	return mux, nil
+	return gateway.PreconditionMiddleware(mux), nil
 }
 
 func dial(ctx context.Context, network, addr string) (*grpc.ClientConn, error) {
@@ -171,8 +481,9 @@ func dialTCP(ctx context.Context, addr string) (*grpc.ClientConn, error) {
 // dialUnix creates a client connection via a unix domain socket.
 // "addr" must be a valid path to the socket.
 func dialUnix(ctx context.Context, addr string) (*grpc.ClientConn, error) {
-	d := func(addr string, timeout time.Duration) (net.Conn, error) {
-		return net.DialTimeout("unix", addr, timeout)
-	}
-	return grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithDialer(d))
+	return grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithDialer(dialUnixSocket))
+}
+
+func dialUnixSocket(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
 }
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// TLSConfig configures the TLS connection to a backend
+type TLSConfig struct {
+	// CAFile is the PEM file of the certificate authorities, the system pool when empty
+	CAFile string
+
+	// ServerName overrides the name the backend certificate is verified against, the
+	// dial target by default. Static backends with several addresses are dialed as
+	// "h1:p,h2:p": it is the host of their addresses when they share one, and is
+	// required otherwise, e.g. the name of the certificate shared by the replicas.
+	ServerName string
+
+	InsecureSkipVerify bool
+}
+
+// TransportCredentials returns the gRPC credentials of the TLS config.
+func (c TLSConfig) TransportCredentials() (credentials.TransportCredentials, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// Backend describes where the gateway finds the gRPC service behind an endpoint
+// handler and how it connects to its replicas.
+type Backend struct {
+	// Service is the micro service name the backend is registered under
+	Service string
+
+	// Addresses are the host:port addresses of the backend replicas, host names
+	// are looked up in DNS, so a headless service name covers every pod.
+	// When neither Service nor Addresses are set the static -endpoint address is dialed.
+	Addresses []string
+
+	// Balancer is RoundRobinBalancer (default) or LeastRequestBalancer
+	Balancer string
+
+	// SubConns is the number of connections opened to every replica
+	SubConns int
+
+	// Keepalive pings idle connections, so dead replicas are detected early
+	Keepalive *keepalive.ClientParameters
+
+	// TLS dials the backend over TLS, plaintext when nil
+	TLS *TLSConfig
+
+	// MaxRecvMsgSize and MaxSendMsgSize override the gRPC message size limits in bytes
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+}
+
+// Target returns the dial target of the backend, resolving the micro service
+// through the registry resolver of the given scheme. The number of connections
+// to every replica is part of the scheme, e.g. "atk-2:///backend:9090".
+func (b Backend) Target(registryScheme, staticEndpoint string) string {
+	if b.Service != "" {
+		return subConnsScheme(registryScheme, b.SubConns) + ":///" + b.Service
+	}
+	if len(b.Addresses) > 0 {
+		return subConnsScheme(staticScheme, b.SubConns) + ":///" + strings.Join(b.Addresses, ",")
+	}
+	return staticEndpoint
+}
+
+// DialOptions returns the backend specific dial options, defaultTLS applies
+// when the backend has no TLS config of its own.
+func (b Backend) DialOptions(defaultTLS *TLSConfig) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	tlsConfig := b.TLS
+	if tlsConfig == nil {
+		tlsConfig = defaultTLS
+	}
+	if tlsConfig != nil {
+		if tlsConfig.ServerName == "" && b.Service == "" && len(b.Addresses) > 1 {
+			serverName, err := sharedHost(b.Addresses)
+			if err != nil {
+				return nil, err
+			}
+			withName := *tlsConfig
+			withName.ServerName = serverName
+			tlsConfig = &withName
+		}
+		creds, err := tlsConfig.TransportCredentials()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if b.Service != "" || len(b.Addresses) > 0 {
+		balancerName := b.Balancer
+		if balancerName == "" {
+			balancerName = RoundRobinBalancer
+		}
+		opts = append(opts, grpc.WithBalancerName(balancerName))
+	}
+	if b.Keepalive != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*b.Keepalive))
+	}
+
+	var callOpts []grpc.CallOption
+	if b.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(b.MaxRecvMsgSize))
+	}
+	if b.MaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(b.MaxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	return opts, nil
+}
+
+// sharedHost returns the host of the addresses, an error when they have different ones.
+func sharedHost(addrs []string) (string, error) {
+	var shared string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if shared != "" && host != shared {
+			return "", fmt.Errorf("the TLS ServerName of the backend %s is required, its addresses have different hosts", strings.Join(addrs, ","))
+		}
+		shared = host
+	}
+	return shared, nil
+}
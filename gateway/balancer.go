@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// RoundRobinBalancer spreads the calls evenly over the backend connections
+	RoundRobinBalancer = roundrobin.Name
+
+	// LeastRequestBalancer sends every call to the connection with the fewest calls in flight
+	LeastRequestBalancer = "least_request"
+)
+
+func init() {
+	balancer.Register(leastRequestBuilder{})
+}
+
+type leastRequestBuilder struct{}
+
+func (leastRequestBuilder) Name() string {
+	return LeastRequestBalancer
+}
+
+// Build creates a picker builder per client connection, so the in-flight
+// counters are not shared between backends.
+func (leastRequestBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pickerBuilder := &leastRequestPickerBuilder{inflight: make(map[balancer.SubConn]*int64)}
+	return base.NewBalancerBuilder(LeastRequestBalancer, pickerBuilder).Build(cc, opts)
+}
+
+type leastRequestPickerBuilder struct {
+	mu       sync.Mutex
+	inflight map[balancer.SubConn]*int64
+}
+
+func (b *leastRequestPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ready := make(map[balancer.SubConn]*int64, len(readySCs))
+	picker := &leastRequestPicker{}
+	for _, sc := range readySCs {
+		counter, ok := b.inflight[sc]
+		if !ok {
+			counter = new(int64)
+		}
+		ready[sc] = counter
+		picker.subConns = append(picker.subConns, sc)
+		picker.inflight = append(picker.inflight, counter)
+	}
+	// forget the connections which went away
+	b.inflight = ready
+	return picker
+}
+
+type leastRequestPicker struct {
+	subConns []balancer.SubConn
+	inflight []*int64
+	next     uint32
+}
+
+func (p *leastRequestPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	// start the scan at a rotating offset, so ties are broken round robin
+	start := int(atomic.AddUint32(&p.next, 1)) % len(p.subConns)
+	best := start
+	for i := 1; i < len(p.subConns); i++ {
+		candidate := (start + i) % len(p.subConns)
+		if atomic.LoadInt64(p.inflight[candidate]) < atomic.LoadInt64(p.inflight[best]) {
+			best = candidate
+		}
+	}
+
+	counter := p.inflight[best]
+	atomic.AddInt64(counter, 1)
+	return p.subConns[best], func(balancer.DoneInfo) { atomic.AddInt64(counter, -1) }, nil
+}
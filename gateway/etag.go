@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	etagHeader    = "ETag"
+	ifMatchHeader = "If-Match"
+)
+
+type preconditionKey struct{}
+
+// PreconditionMiddleware returns 412 Precondition Failed when a request carrying If-Match
+// fails with ABORTED or FAILED_PRECONDITION, i.e. the document changed since the client read it.
+// The calls are marked failed by PreconditionInterceptor, the errors being written as usual.
+// It replaces a proto error handler of the mux: grpc-gateway v1.9 still sets the package
+// HTTPError and OtherErrorHandler from it, shared by every gateway of the process.
+func PreconditionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ifMatchHeader) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &preconditionWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r.WithContext(context.WithValue(r.Context(), preconditionKey{}, pw)))
+	})
+}
+
+// PreconditionInterceptor marks the calls of the requests of PreconditionMiddleware which
+// failed with ABORTED or FAILED_PRECONDITION.
+func PreconditionInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if pw, ok := ctx.Value(preconditionKey{}).(*preconditionWriter); ok {
+		switch status.Code(err) {
+		case codes.Aborted, codes.FailedPrecondition:
+			pw.failed = true
+		}
+	}
+	return err
+}
+
+// preconditionWriter writes 412 instead of the error status once the call is marked failed
+type preconditionWriter struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (w *preconditionWriter) WriteHeader(code int) {
+	if w.failed && code >= http.StatusBadRequest {
+		code = http.StatusPreconditionFailed
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
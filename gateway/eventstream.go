@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lastEventIDHeader = "Last-Event-ID"
+
+// EventIDField is the field of the streamed messages sent as the id of their Server-Sent
+// Event, e.g. the resume token of a change, which the clients send back as Last-Event-ID
+// when they reconnect.
+var EventIDField = "resume_token"
+
+// EventStreamHeartbeat is the interval of the comments keeping the idle event streams open
+// through the proxies
+var EventStreamHeartbeat = 15 * time.Second
+
+// EventStreamMiddleware serves the server streaming RPCs as Server-Sent Events to the
+// requests accepting text/event-stream: every message of the stream is an event, and a
+// stream error an "error" event. The other requests are left as they are.
+func EventStreamMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &eventStreamWriter{ResponseWriter: w, flusher: flusher}
+		done := make(chan struct{})
+		go sw.heartbeat(done)
+		next.ServeHTTP(sw, r)
+		close(done)
+		sw.finish()
+	})
+}
+
+// eventStreamWriter turns the newline delimited JSON chunks of the gateway streams,
+// {"result": ...} or {"error": ...}, into events
+type eventStreamWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+
+	mu          sync.Mutex
+	wroteHeader bool
+	streaming   bool
+	buf         bytes.Buffer
+}
+
+func (w *eventStreamWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeHeaderLocked(code)
+}
+
+func (w *eventStreamWriter) writeHeaderLocked(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// the unary calls and the errors before the stream are answered as usual
+	w.streaming = code == http.StatusOK && w.Header().Get("Transfer-Encoding") == "chunked"
+	if w.streaming {
+		w.Header().Del("Transfer-Encoding")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *eventStreamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeHeaderLocked(http.StatusOK)
+	if !w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadBytes('\n')
+		if err != nil {
+			// keep the partial chunk for the next write
+			rest := append([]byte(nil), line...)
+			w.buf.Reset()
+			w.buf.Write(rest)
+			return len(p), nil
+		}
+		if err := w.writeEvent(bytes.TrimSpace(line)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// finish writes the last chunk, the stream errors having no delimiter, and stops the
+// writes of the heartbeat.
+func (w *eventStreamWriter) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.streaming {
+		w.writeEvent(bytes.TrimSpace(w.buf.Bytes()))
+		w.flusher.Flush()
+	}
+	w.streaming = false
+}
+
+func (w *eventStreamWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flusher.Flush()
+}
+
+// writeEvent writes a chunk of the stream as an event.
+func (w *eventStreamWriter) writeEvent(chunk []byte) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	message := struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}{}
+	if err := json.Unmarshal(chunk, &message); err != nil {
+		return fmt.Errorf("gateway: invalid stream chunk: %v", err)
+	}
+
+	var event bytes.Buffer
+	data := message.Result
+	if message.Error != nil {
+		event.WriteString("event: error\n")
+		data = message.Error
+	} else if id := eventID(message.Result); id != "" {
+		event.WriteString("id: " + id + "\n")
+	}
+	event.WriteString("data: ")
+	event.Write(data)
+	event.WriteString("\n\n")
+	_, err := w.ResponseWriter.Write(event.Bytes())
+	return err
+}
+
+func (w *eventStreamWriter) heartbeat(done <-chan struct{}) {
+	ticker := time.NewTicker(EventStreamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.streaming {
+				w.ResponseWriter.Write([]byte(": heartbeat\n\n"))
+				w.flusher.Flush()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// eventID returns the EventIDField of the message, without the newlines which would end the id.
+func eventID(result json.RawMessage) string {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return ""
+	}
+	id, _ := fields[EventIDField].(string)
+	return strings.NewReplacer("\n", "", "\r", "").Replace(id)
+}
@@ -18,7 +18,6 @@ import (
 	"google.golang.org/grpc"
 	"time"
 	"github.com/google/uuid"
-	"crypto/rsa"
 )
 
 type UserInfo struct {
@@ -35,12 +34,23 @@ const (
 	isAdminKeyStr = "IsAdmin"
 )
 
-var (
-	clientID          = ""
-	keyCloakIssuerUrl = ""
-	verifyKey         *rsa.PublicKey
-	environment       = "dev"
-)
+// AuthConfig configures the verification of the bearer tokens against the OIDC issuer
+type AuthConfig struct {
+	// IssuerURL is the keycloak issuer url
+	IssuerURL string
+
+	// ClientID is the audience the tokens are issued for
+	ClientID string
+
+	// InsecureSkipVerify skips the TLS verification of the issuer
+	InsecureSkipVerify bool
+
+	// EventStreamTokenParam is the query parameter holding the bearer token of the
+	// text/event-stream requests without Authorization header, e.g. "access_token":
+	// the browser EventSource can't send headers. The URLs end up in the access logs,
+	// the tokens sent this way should be short-lived. Off when empty.
+	EventStreamTokenParam string
+}
 
 // swaggerServer returns swagger specification files located under "/swagger/"
 func ServeSwaggerJSON(dir string) http.HandlerFunc {
@@ -67,31 +77,51 @@ func SwaggerServer(mux *http.ServeMux) {
 	mux.Handle(prefix, http.StripPrefix(prefix, http.FileServer(swaggerFS)))
 }
 
-func WithClientUnaryInterceptor(env string) grpc.DialOption {
-	environment = env
-	return grpc.WithUnaryInterceptor(clientInterceptor)
+// WithClientUnaryInterceptor logs every backend RPC and runs the given
+// interceptors inside the logging one, in order.
+func WithClientUnaryInterceptor(env string, interceptors ...grpc.UnaryClientInterceptor) grpc.DialOption {
+	return grpc.WithUnaryInterceptor(chainUnaryClient(append([]grpc.UnaryClientInterceptor{newClientInterceptor(env)}, interceptors...)))
 }
 
-func clientInterceptor(
-	ctx context.Context,
-	method string,
-	req interface{},
-	reply interface{},
-	cc *grpc.ClientConn,
-	invoker grpc.UnaryInvoker,
-	opts ...grpc.CallOption,
-) error {
-	// Logic before invoking the invoker
-	start := time.Now()
-	_, err := uuid.NewUUID()
+// chainUnaryClient combines the interceptors into one, the first being the outermost.
+func chainUnaryClient(interceptors []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		chained := invoker
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			chained = bindInvoker(interceptors[i], chained)
+		}
+		return chained(ctx, method, req, reply, cc, opts...)
+	}
+}
 
-	// Calls the invoker to execute RPC
-	err = invoker(ctx, method, req, reply, cc, opts...)
-	// Logic after invoking the invoker
-	glog.Infof("Invoked RPC method=%s; Duration=%s; Error=%v;", method,
-		time.Since(start), err)
+func bindInvoker(interceptor grpc.UnaryClientInterceptor, next grpc.UnaryInvoker) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return interceptor(ctx, method, req, reply, cc, next, opts...)
+	}
+}
+
+func newClientInterceptor(env string) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req interface{},
+		reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		// Logic before invoking the invoker
+		start := time.Now()
+		_, err := uuid.NewUUID()
 
-	return err
+		// Calls the invoker to execute RPC
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		// Logic after invoking the invoker
+		glog.Infof("Invoked RPC env=%s; method=%s; Duration=%s; Error=%v;", env, method,
+			time.Since(start), err)
+
+		return err
+	}
 }
 
 func DefaultAuthMiddleware(ctxt context.Context, next http.Handler) http.Handler {
@@ -100,22 +130,31 @@ func DefaultAuthMiddleware(ctxt context.Context, next http.Handler) http.Handler
 		next.ServeHTTP(w, r)
 	})
 }
+// AuthMiddleware verifies the bearer tokens without issuer settings, use NewAuthMiddleware.
 func AuthMiddleware(ctxt context.Context, next http.Handler) http.Handler {
+	return NewAuthMiddleware(ctxt, AuthConfig{InsecureSkipVerify: true}, next)
+}
+
+// NewAuthMiddleware requires a bearer token verified against the issuer of the auth config.
+func NewAuthMiddleware(ctxt context.Context, auth AuthConfig, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 			tr := &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: auth.InsecureSkipVerify},
 			}
 			sslcli := &http.Client{Transport: tr}
 			ctx := context.WithValue(ctxt, oauth2.HTTPClient, sslcli)
 
 			authorizationHeader := r.Header.Get("authorization")
+			if authorizationHeader == "" {
+				authorizationHeader, r = eventStreamToken(auth, r)
+			}
 			if authorizationHeader != "" {
 				bearerToken := strings.Split(authorizationHeader, " ")
 
 				if len(bearerToken) == 2 {
 					/* verify the token from keycloak issuer url */
-					userInfo, err := verifyBearerToken(ctx, keyCloakIssuerUrl, bearerToken, r)
+					userInfo, err := verifyBearerToken(ctx, auth, bearerToken, r)
 					if err != nil {
 
 						http.Error(w, "idTokenVerifier: Failed to verify ID Token: "+err.Error(), http.StatusUnauthorized)
@@ -135,11 +174,30 @@ func AuthMiddleware(ctxt context.Context, next http.Handler) http.Handler {
 	})
 }
 
+// eventStreamToken takes the bearer token of an event stream request from the query,
+// and removes it from the request forwarded to the backend.
+func eventStreamToken(auth AuthConfig, r *http.Request) (string, *http.Request) {
+	if auth.EventStreamTokenParam == "" || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return "", r
+	}
+	query := r.URL.Query()
+	token := query.Get(auth.EventStreamTokenParam)
+	if token == "" {
+		return "", r
+	}
+	query.Del(auth.EventStreamTokenParam)
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	r = r.WithContext(r.Context())
+	r.URL = &u
+	return "Bearer " + token, r
+}
+
 /*
  * verifyBearerToken
  */
-func verifyBearerToken(ctx context.Context, issuerUrl string, bearerToken []string, r *http.Request) (*UserInfo, error) {
-	idTokenVerifier, err := initVerifier(ctx, &oidc.Config{ClientID: clientID}, issuerUrl)
+func verifyBearerToken(ctx context.Context, auth AuthConfig, bearerToken []string, r *http.Request) (*UserInfo, error) {
+	idTokenVerifier, err := initVerifier(ctx, &oidc.Config{ClientID: auth.ClientID}, auth.IssuerURL)
 
 	if err != nil {
 		return nil, err
@@ -163,12 +221,32 @@ func initVerifier(ctx context.Context, config *oidc.Config, iss string) (*oidc.I
 	return provider.Verifier(config), nil
 }
 
+// CORSConfig lists the cross origin requests allowed by the gateway
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+}
+
 func SetupGlobalMiddleware(handler http.Handler) http.Handler {
 	handleCORS := cors.Default().Handler
 
 	return handleCORS(handler)
 }
 
+// SetupCORSMiddleware allows the cross origin requests of the config only.
+func SetupCORSMiddleware(config CORSConfig, handler http.Handler) http.Handler {
+	handleCORS := cors.New(cors.Options{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowedMethods:   config.AllowedMethods,
+		AllowedHeaders:   config.AllowedHeaders,
+		AllowCredentials: config.AllowCredentials,
+	}).Handler
+
+	return handleCORS(handler)
+}
+
 func ForwardAuthenticationMetadata(ctx context.Context, r *http.Request) metadata.MD {
 	md := metadata.MD{}
 	if user := r.Context().Value(userCtxKey{}); user != nil {
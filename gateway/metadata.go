@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	gwruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	clientIPKeyStr = "Client-IP"
+)
+
+// HeaderConfig controls which HTTP headers reach the backend services as gRPC
+// metadata and which metadata set by the services is returned to the client.
+type HeaderConfig struct {
+	// IncomingAllowlist is the list of HTTP request headers forwarded as metadata
+	IncomingAllowlist []string
+
+	// IncomingRenames maps an HTTP request header to the metadata key it is forwarded as
+	IncomingRenames map[string]string
+
+	// OutgoingAllowlist is the list of metadata keys returned as plain HTTP response headers
+	OutgoingAllowlist []string
+
+	// OutgoingRenames maps a metadata key to the HTTP response header it is returned as
+	OutgoingRenames map[string]string
+
+	// ReservedPrefixes are metadata keys only the gateway itself may set, an entry
+	// ending with "-" blocks every key with that prefix. Any incoming header
+	// resolving to a reserved key is dropped.
+	ReservedPrefixes []string
+
+	// TrustedProxyHops is the number of proxies in front of the gateway whose
+	// X-Forwarded-For / X-Real-IP are trusted, the remote address of the connection
+	// is taken when 0.
+	TrustedProxyHops int
+}
+
+// DefaultHeaderConfig forwards the common tracing and locale headers, the
+// ETag / If-Match of the document versions and the Last-Event-ID of the event
+// streams, and blocks clients from spoofing
+// the authentication metadata.
+var DefaultHeaderConfig = HeaderConfig{
+	IncomingAllowlist: []string{"Accept-Language", "X-Tenant", "X-Correlation-ID", "X-Request-ID", ifMatchHeader, lastEventIDHeader},
+	OutgoingAllowlist: []string{"X-Correlation-ID", "X-Request-ID", etagHeader},
+	ReservedPrefixes:  []string{userKeyStr, isAdminKeyStr, clientIPKeyStr},
+}
+
+// IncomingHeaderMatcher returns the grpc-gateway matcher translating HTTP
+// request headers into gRPC metadata keys.
+func (c HeaderConfig) IncomingHeaderMatcher() gwruntime.HeaderMatcherFunc {
+	allowed := toHeaderSet(c.IncomingAllowlist)
+	renames := make(map[string]string, len(c.IncomingRenames))
+	for header, key := range c.IncomingRenames {
+		renames[textproto.CanonicalMIMEHeaderKey(header)] = key
+	}
+
+	return func(key string) (string, bool) {
+		header := textproto.CanonicalMIMEHeaderKey(key)
+
+		var mdKey string
+		if renamed, ok := renames[header]; ok {
+			mdKey = renamed
+		} else if allowed[header] {
+			mdKey = header
+		} else if defaultKey, ok := gwruntime.DefaultHeaderMatcher(key); ok {
+			mdKey = defaultKey
+		} else {
+			return "", false
+		}
+
+		if c.isReserved(mdKey) {
+			return "", false
+		}
+		return strings.ToLower(mdKey), true
+	}
+}
+
+// OutgoingHeaderMatcher returns the grpc-gateway matcher translating the
+// header metadata set by a service into HTTP response headers.
+func (c HeaderConfig) OutgoingHeaderMatcher() gwruntime.HeaderMatcherFunc {
+	allowed := toHeaderSet(c.OutgoingAllowlist)
+	renames := make(map[string]string, len(c.OutgoingRenames))
+	for key, header := range c.OutgoingRenames {
+		renames[strings.ToLower(key)] = header
+	}
+
+	return func(key string) (string, bool) {
+		if header, ok := renames[strings.ToLower(key)]; ok {
+			return header, true
+		}
+		header := textproto.CanonicalMIMEHeaderKey(key)
+		if allowed[header] {
+			return header, true
+		}
+		return gwruntime.MetadataHeaderPrefix + key, true
+	}
+}
+
+// ForwardClientIPMetadata adds the address of the calling client to the metadata.
+func (c HeaderConfig) ForwardClientIPMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	if ip := ClientIP(r, c.TrustedProxyHops); ip != "" {
+		md.Set(clientIPKeyStr, ip)
+	}
+	return md
+}
+
+func (c HeaderConfig) isReserved(key string) bool {
+	key = strings.ToLower(key)
+	for _, reserved := range c.ReservedPrefixes {
+		reserved = strings.ToLower(reserved)
+		if key == reserved || (strings.HasSuffix(reserved, "-") && strings.HasPrefix(key, reserved)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client which sent the request. Behind trusted
+// proxies, it is the X-Forwarded-For entry added by the furthest one: every proxy appends
+// the address it received the request from, the entries on the left can be sent by anyone.
+func ClientIP(r *http.Request, trustedProxyHops int) string {
+	if trustedProxyHops > 0 {
+		if forwarded := r.Header["X-Forwarded-For"]; len(forwarded) > 0 {
+			entries := strings.Split(strings.Join(forwarded, ","), ",")
+			i := len(entries) - trustedProxyHops
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(entries[i])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func toHeaderSet(headers []string) map[string]bool {
+	set := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		set[textproto.CanonicalMIMEHeaderKey(header)] = true
+	}
+	return set
+}
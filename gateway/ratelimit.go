@@ -0,0 +1,205 @@
+package gateway
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/patrickmn/go-cache"
+)
+
+// RateLimit is a token bucket holding up to Burst requests, refilled with
+// Requests tokens every Period.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+func (l RateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// ratePerSecond is the number of tokens added to the bucket every second.
+func (l RateLimit) ratePerSecond() float64 {
+	if l.Period <= 0 {
+		return float64(l.Requests)
+	}
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitConfig describes the limits applied by the gateway.
+type RateLimitConfig struct {
+	// Default applies to every route without a more specific limit
+	Default RateLimit
+
+	// Routes maps an URL path prefix to its limit, the longest prefix wins
+	Routes map[string]RateLimit
+
+	// KeyFunc identifies the caller, defaults to the authenticated user,
+	// then the X-API-Key header if ValidAPIKey accepts it, then the client IP.
+	KeyFunc func(*http.Request) string
+
+	// ValidAPIKey checks the X-API-Key header before the limits are keyed on it,
+	// the header is ignored when nil: anyone could send a new key for every request.
+	ValidAPIKey func(apiKey string) bool
+
+	// TrustedProxyHops is the number of trusted proxies in front of the gateway,
+	// see ClientIP.
+	TrustedProxyHops int
+}
+
+// RateLimitResult is the state of a caller's bucket after taking a token.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the rate limit state of every caller.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// RateLimitMiddleware rejects requests above the configured limits with 429 Too Many Requests.
+// It has to run after the authentication middleware to key the limits on the user.
+func RateLimitMiddleware(cfg RateLimitConfig, store RateLimitStore, next http.Handler) http.Handler {
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	keyFunc := cfg.KeyFunc
+	if keyFunc == nil {
+		keyFunc = DefaultRateLimitKey(cfg.TrustedProxyHops)
+		if cfg.ValidAPIKey != nil {
+			keyFunc = APIKeyRateLimitKey(cfg.TrustedProxyHops, cfg.ValidAPIKey)
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, limit := cfg.limitFor(r.URL.Path)
+		if limit.Requests <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := store.Take(r.Context(), route+"|"+keyFunc(r), limit)
+		if err != nil {
+			// fail open, an unavailable store must not take the gateway down
+			glog.Errorf("Rate limit store failed: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DefaultRateLimitKey keys the limits on the authenticated user or the client IP.
+func DefaultRateLimitKey(trustedProxyHops int) func(*http.Request) string {
+	return APIKeyRateLimitKey(trustedProxyHops, nil)
+}
+
+// APIKeyRateLimitKey keys the limits on the authenticated user, the API key if valid
+// accepts it, or the client IP. The invalid keys are limited on the client IP.
+func APIKeyRateLimitKey(trustedProxyHops int, valid func(apiKey string) bool) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if user, ok := r.Context().Value(userCtxKey{}).(string); ok && user != "" {
+			return "user:" + user
+		}
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" && valid != nil && valid(apiKey) {
+			return "apikey:" + apiKey
+		}
+		return "ip:" + ClientIP(r, trustedProxyHops)
+	}
+}
+
+func (c RateLimitConfig) limitFor(path string) (string, RateLimit) {
+	route, limit := "", c.Default
+	for prefix, routeLimit := range c.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(route) {
+			route, limit = prefix, routeLimit
+		}
+	}
+	return route, limit
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// memoryRateLimitStore keeps token buckets in the gateway process.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets *cache.Cache
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryRateLimitStore returns a store local to this gateway replica.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: cache.New(10*time.Minute, 10*time.Minute),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	bucket := &tokenBucket{tokens: limit.capacity(), last: now}
+	if cached, ok := s.buckets.Get(key); ok {
+		bucket = cached.(*tokenBucket)
+	}
+	result := bucket.take(now, limit)
+
+	// a bucket can be forgotten once it would have been refilled completely
+	s.buckets.Set(key, bucket, result.Reset+time.Second)
+	return result, nil
+}
+
+// take refills the bucket for the time elapsed since the last request, then takes a token.
+func (b *tokenBucket) take(now time.Time, limit RateLimit) RateLimitResult {
+	capacity, rate := limit.capacity(), limit.ratePerSecond()
+	// the clocks of the replicas sharing a bucket may be a bit late
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+
+	result := RateLimitResult{Limit: int(capacity)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((capacity - b.tokens) / rate)
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/lakstap/go-atk/database"
+)
+
+// rateLimitAttempts is the number of times a bucket changed by another replica is read again
+const rateLimitAttempts = 5
+
+// errRateLimitContention is returned when the bucket kept changing, the middleware fails open
+var errRateLimitContention = errors.New("the rate limit bucket is changed concurrently")
+
+// mongoRateLimitStore shares the token buckets between all gateway replicas. The buckets
+// are updated optimistically: an update only applies to the version of the bucket it read.
+type mongoRateLimitStore struct {
+	collection *mongo.Collection
+}
+
+type rateLimitBucket struct {
+	Tokens  float64   `bson:"tokens"`
+	Last    time.Time `bson:"last"`
+	Version int64     `bson:"version"`
+}
+
+// NewMongoRateLimitStore returns a store keeping token buckets in a Mongo collection,
+// the buckets refilled completely are removed by a TTL index on "expireAt".
+func NewMongoRateLimitStore(session *mdb.DatabaseSession, collection string) (RateLimitStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	coll := session.Collection(collection)
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoRateLimitStore{collection: coll}, nil
+}
+
+func (s *mongoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	for i := 0; i < rateLimitAttempts; i++ {
+		result, ok, err := s.take(ctx, key, limit)
+		if err != nil || ok {
+			return result, err
+		}
+	}
+	return RateLimitResult{}, errRateLimitContention
+}
+
+// take reads the bucket and writes it back with a token less, ok is false when another
+// replica changed or created the bucket in between.
+func (s *mongoRateLimitStore) take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, bool, error) {
+	now := time.Now()
+	stored := rateLimitBucket{}
+	err := s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&stored)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return RateLimitResult{}, false, err
+	}
+	found := err == nil
+
+	bucket := &tokenBucket{tokens: limit.capacity(), last: now}
+	if found {
+		bucket = &tokenBucket{tokens: stored.Tokens, last: stored.Last}
+	}
+	result := bucket.take(now, limit)
+
+	doc := bson.M{
+		"tokens":   bucket.tokens,
+		"last":     bucket.last,
+		"version":  stored.Version + 1,
+		"expireAt": now.Add(result.Reset + time.Second),
+	}
+	if !found {
+		doc["_id"] = key
+		_, err = s.collection.InsertOne(ctx, doc)
+		if mdb.IsDuplicateKey(err) {
+			// created by another replica since, read it again
+			return RateLimitResult{}, false, nil
+		}
+		return result, err == nil, err
+	}
+
+	res, err := s.collection.UpdateOne(ctx, bson.M{"_id": key, "version": stored.Version}, bson.M{"$set": doc})
+	if err != nil {
+		return RateLimitResult{}, false, err
+	}
+	return result, res.MatchedCount == 1, nil
+}
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/micro/go-micro/registry"
+	"google.golang.org/grpc/resolver"
+)
+
+var (
+	registrySchemesMu sync.Mutex
+	registrySchemes   = make(map[registry.Registry]string)
+)
+
+// RegisterRegistryResolver makes the services of the registry dialable as
+// "<scheme>:///<micro service name>" and returns the scheme. Every registry
+// gets its own scheme, so gateways using different registries don't clash.
+func RegisterRegistryResolver(reg registry.Registry) string {
+	registrySchemesMu.Lock()
+	defer registrySchemesMu.Unlock()
+
+	if scheme, ok := registrySchemes[reg]; ok {
+		return scheme
+	}
+	scheme := "micro"
+	if len(registrySchemes) > 0 {
+		scheme = fmt.Sprintf("micro%d", len(registrySchemes))
+	}
+	registerResolver(scheme, func(scheme string, subConns int) resolver.Builder {
+		return &registryResolverBuilder{scheme: scheme, registry: reg, subConns: subConns}
+	})
+	registrySchemes[reg] = scheme
+	return scheme
+}
+
+type registryResolverBuilder struct {
+	scheme   string
+	registry registry.Registry
+	subConns int
+}
+
+func (b *registryResolverBuilder) Scheme() string {
+	return b.scheme
+}
+
+func (b *registryResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	r := &registryResolver{
+		service:    target.Endpoint,
+		subConns:   b.subConns,
+		registry:   b.registry,
+		cc:         cc,
+		resolveNow: make(chan struct{}, 1),
+		watchErr:   make(chan error, 1),
+		done:       make(chan struct{}),
+	}
+	r.resolve()
+	go r.watch()
+	return r, nil
+}
+
+// registryResolver keeps the addresses of a micro service up to date
+// by watching the registry.
+type registryResolver struct {
+	service    string
+	subConns   int
+	registry   registry.Registry
+	cc         resolver.ClientConn
+	resolveNow chan struct{}
+	watchErr   chan error
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	mu      sync.Mutex
+	watcher registry.Watcher
+	closed  bool
+}
+
+func (r *registryResolver) ResolveNow(resolver.ResolveNowOption) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *registryResolver) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.watcher != nil {
+		r.watcher.Stop()
+	}
+}
+
+func (r *registryResolver) resolve() {
+	services, err := r.registry.GetService(r.service)
+	if err == registry.ErrNotFound {
+		// the service is gone, unlike the lookup errors which keep the last addresses
+		services, err = nil, nil
+	}
+	if err != nil {
+		glog.Errorf("Failed to resolve service %s from the registry: %v", r.service, err)
+		return
+	}
+	var addrs []string
+	for _, service := range services {
+		for _, node := range service.Nodes {
+			addrs = append(addrs, nodeAddress(node))
+		}
+	}
+	glog.Infof("Resolved service %s to %d nodes", r.service, len(addrs))
+	r.cc.NewAddress(expandSubConns(addrs, r.subConns))
+}
+
+func (r *registryResolver) watch() {
+	for {
+		watcher, err := r.registry.Watch()
+		if err == nil {
+			r.mu.Lock()
+			if r.closed {
+				r.mu.Unlock()
+				watcher.Stop()
+				return
+			}
+			r.watcher = watcher
+			r.mu.Unlock()
+			go r.forward(watcher)
+			err = r.waitEvents()
+		}
+
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		glog.Errorf("Watching the registry for %s failed: %v", r.service, err)
+
+		// re-resolve and watch again, events may have been missed in between
+		select {
+		case <-r.done:
+			return
+		case <-time.After(time.Second):
+			r.resolve()
+		}
+	}
+}
+
+// waitEvents resolves the service on every change until the watcher fails.
+func (r *registryResolver) waitEvents() error {
+	for {
+		select {
+		case <-r.done:
+			return nil
+		case <-r.resolveNow:
+			r.resolve()
+		case err := <-r.watchErr:
+			return err
+		}
+	}
+}
+
+// forward turns the registry events of the service into resolve requests.
+func (r *registryResolver) forward(watcher registry.Watcher) {
+	for {
+		result, err := watcher.Next()
+		if err != nil {
+			r.watchErr <- err
+			return
+		}
+		if result.Service != nil && result.Service.Name == r.service {
+			r.ResolveNow(resolver.ResolveNowOption{})
+		}
+	}
+}
+
+func nodeAddress(node *registry.Node) string {
+	if node.Port > 0 {
+		return net.JoinHostPort(node.Address, strconv.Itoa(node.Port))
+	}
+	return node.Address
+}
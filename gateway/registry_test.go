@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/registry"
+	"github.com/micro/go-micro/registry/memory"
+	"google.golang.org/grpc/resolver"
+)
+
+// testRegistry is a memory registry whose watch events are sent once the change is made,
+// and whose lookups and watchers fail on demand. The memory registry changes the services
+// it returned, the lookups return copies.
+type testRegistry struct {
+	registry.Registry
+	events   chan *registry.Result
+	watchErr chan error
+
+	mu     sync.Mutex
+	getErr error
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		Registry: memory.NewRegistry(),
+		events:   make(chan *registry.Result, 10),
+		watchErr: make(chan error, 1),
+	}
+}
+
+func (r *testRegistry) GetService(name string) ([]*registry.Service, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.getErr != nil {
+		return nil, r.getErr
+	}
+	services, err := r.Registry.GetService(name)
+	if err != nil {
+		return nil, err
+	}
+	copies := make([]*registry.Service, 0, len(services))
+	for _, service := range services {
+		copied := *service
+		copied.Nodes = append([]*registry.Node(nil), service.Nodes...)
+		copies = append(copies, &copied)
+	}
+	return copies, nil
+}
+
+func (r *testRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	r.mu.Lock()
+	err := r.Registry.Register(s, opts...)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.events <- &registry.Result{Action: "update", Service: s}
+	return nil
+}
+
+func (r *testRegistry) Deregister(s *registry.Service) error {
+	r.mu.Lock()
+	err := r.Registry.Deregister(s)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	r.events <- &registry.Result{Action: "delete", Service: s}
+	return nil
+}
+
+func (r *testRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return &testWatcher{registry: r, stop: make(chan struct{})}, nil
+}
+
+func (r *testRegistry) failLookups(err error) {
+	r.mu.Lock()
+	r.getErr = err
+	r.mu.Unlock()
+}
+
+type testWatcher struct {
+	registry *testRegistry
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func (w *testWatcher) Next() (*registry.Result, error) {
+	select {
+	case result := <-w.registry.events:
+		return result, nil
+	case err := <-w.registry.watchErr:
+		return nil, err
+	case <-w.stop:
+		return nil, errors.New("watcher stopped")
+	}
+}
+
+func (w *testWatcher) Stop() {
+	w.once.Do(func() { close(w.stop) })
+}
+
+// testClientConn records the addresses sent by the resolver.
+type testClientConn struct {
+	resolver.ClientConn
+	updates chan []string
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{updates: make(chan []string, 10)}
+}
+
+func (cc *testClientConn) NewAddress(addresses []resolver.Address) {
+	addrs := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		addrs = append(addrs, address.Addr)
+	}
+	sort.Strings(addrs)
+	cc.updates <- addrs
+}
+
+// waitAddresses waits for the resolver to send the addresses, skipping the previous updates.
+func (cc *testClientConn) waitAddresses(t *testing.T, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case addrs := <-cc.updates:
+			if len(addrs) == len(want) && (len(want) == 0 || reflect.DeepEqual(addrs, want)) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the resolver did not send the addresses %v", want)
+		}
+	}
+}
+
+func testService(nodes ...*registry.Node) *registry.Service {
+	return &registry.Service{Name: "go.micro.srv.test", Version: "1", Nodes: nodes}
+}
+
+func buildTestResolver(t *testing.T, reg registry.Registry) (resolver.Resolver, *testClientConn) {
+	t.Helper()
+	cc := newTestClientConn()
+	builder := &registryResolverBuilder{scheme: "microtest", registry: reg}
+	r, err := builder.Build(resolver.Target{Scheme: "microtest", Endpoint: "go.micro.srv.test"}, cc, resolver.BuildOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, cc
+}
+
+func TestRegistryResolverInitialResolution(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Register(testService(
+		&registry.Node{Id: "a", Address: "10.0.0.1", Port: 9090},
+		&registry.Node{Id: "b", Address: "10.0.0.2:9091"},
+	))
+
+	r, cc := buildTestResolver(t, reg)
+	defer r.Close()
+	cc.waitAddresses(t, "10.0.0.1:9090", "10.0.0.2:9091")
+}
+
+func TestRegistryResolverWatch(t *testing.T) {
+	reg := newTestRegistry()
+	nodeA := &registry.Node{Id: "a", Address: "10.0.0.1", Port: 9090}
+	reg.Register(testService(nodeA))
+
+	r, cc := buildTestResolver(t, reg)
+	defer r.Close()
+	cc.waitAddresses(t, "10.0.0.1:9090")
+
+	nodeB := &registry.Node{Id: "b", Address: "10.0.0.2", Port: 9090}
+	reg.Register(testService(nodeB))
+	cc.waitAddresses(t, "10.0.0.1:9090", "10.0.0.2:9090")
+
+	reg.Deregister(testService(nodeA))
+	cc.waitAddresses(t, "10.0.0.2:9090")
+}
+
+func TestRegistryResolverRemovedService(t *testing.T) {
+	reg := newTestRegistry()
+	node := &registry.Node{Id: "a", Address: "10.0.0.1", Port: 9090}
+	reg.Register(testService(node))
+
+	r, cc := buildTestResolver(t, reg)
+	cc.waitAddresses(t, "10.0.0.1:9090")
+
+	reg.Deregister(testService(node))
+	cc.waitAddresses(t)
+
+	// closing twice, e.g. by grpc and by the gateway, must not panic
+	r.Close()
+	r.Close()
+}
+
+func TestRegistryResolverErrorsKeepTheAddresses(t *testing.T) {
+	reg := newTestRegistry()
+	reg.Register(testService(&registry.Node{Id: "a", Address: "10.0.0.1", Port: 9090}))
+
+	r, cc := buildTestResolver(t, reg)
+	defer r.Close()
+	cc.waitAddresses(t, "10.0.0.1:9090")
+
+	// a failed lookup after a change, then a failed watcher which re-resolves
+	reg.failLookups(errors.New("registry unavailable"))
+	reg.Register(testService(&registry.Node{Id: "b", Address: "10.0.0.2", Port: 9090}))
+	reg.watchErr <- errors.New("watch failed")
+	select {
+	case addrs := <-cc.updates:
+		t.Fatalf("the resolver replaced the addresses with %v on errors", addrs)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// the watcher is opened again and the next change is resolved
+	reg.failLookups(nil)
+	reg.Register(testService(&registry.Node{Id: "c", Address: "10.0.0.3", Port: 9090}))
+	cc.waitAddresses(t, "10.0.0.1:9090", "10.0.0.2:9090", "10.0.0.3:9090")
+}
@@ -0,0 +1,277 @@
+package gateway
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// circuit breaker state and retry counts per backend, served on /debug/vars
+	breakerStates  = expvar.NewMap("atk_circuit_breaker_state")
+	backendRetries = expvar.NewMap("atk_backend_retries")
+	breakerRejects = expvar.NewMap("atk_circuit_breaker_rejected")
+)
+
+// CallPolicy controls the deadline and retries of a backend RPC.
+type CallPolicy struct {
+	// Timeout is the deadline of each attempt, unless the caller's is earlier
+	Timeout time.Duration
+
+	// MaxAttempts is the number of attempts for idempotent methods, including the first one
+	MaxAttempts int
+
+	// InitialBackoff, MaxBackoff and BackoffMultiplier shape the exponential
+	// backoff between two attempts.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// RetryableCodes are the status codes an attempt is retried on
+	RetryableCodes []codes.Code
+
+	// Idempotent marks methods which are safe to retry
+	Idempotent bool
+}
+
+// BreakerPolicy controls the circuit breaker of a backend.
+type BreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failures opening the breaker, 0 disables it
+	FailureThreshold int
+
+	// OpenTimeout is how long the breaker fails fast before letting a probe call through
+	OpenTimeout time.Duration
+}
+
+// BackendPolicy is the policy of a backend gRPC service.
+type BackendPolicy struct {
+	// Default applies to every method without its own policy
+	Default CallPolicy
+
+	// Methods maps a method name (e.g. "GetProject") to its policy
+	Methods map[string]CallPolicy
+
+	Breaker BreakerPolicy
+}
+
+// ResilienceConfig holds the policies of the backends keyed by the
+// fully qualified gRPC service name (e.g. "atk.project.ProjectService").
+type ResilienceConfig struct {
+	Default  BackendPolicy
+	Backends map[string]BackendPolicy
+}
+
+// DefaultBackendPolicy gives every call a deadline and retries idempotent
+// methods on UNAVAILABLE.
+var DefaultBackendPolicy = BackendPolicy{
+	Default: CallPolicy{
+		Timeout:           30 * time.Second,
+		MaxAttempts:       3,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		BackoffMultiplier: 2,
+		RetryableCodes:    []codes.Code{codes.Unavailable},
+	},
+	Breaker: BreakerPolicy{
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	},
+}
+
+func (c ResilienceConfig) policyFor(backend, method string) (CallPolicy, BreakerPolicy) {
+	policy, ok := c.Backends[backend]
+	if !ok {
+		policy = c.Default
+	}
+	if callPolicy, ok := policy.Methods[method]; ok {
+		return callPolicy, policy.Breaker
+	}
+	return policy.Default, policy.Breaker
+}
+
+func (p CallPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, retryable := range p.RetryableCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+func (p CallPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= p.BackoffMultiplier
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	// full jitter, so replicas don't retry in lockstep
+	return time.Duration(rand.Float64() * backoff)
+}
+
+// ResilienceInterceptor applies the deadlines, retries and circuit breakers of the config.
+func ResilienceInterceptor(config ResilienceConfig) grpc.UnaryClientInterceptor {
+	breakers := &breakerSet{breakers: make(map[string]*circuitBreaker)}
+
+	return func(
+		ctx context.Context,
+		method string,
+		req interface{},
+		reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		backend, methodName := splitMethod(method)
+		policy, breakerPolicy := config.policyFor(backend, methodName)
+		breaker := breakers.get(backend, breakerPolicy)
+
+		for attempt := 1; ; attempt++ {
+			if !breaker.allow() {
+				breakerRejects.Add(backend, 1)
+				return status.Errorf(codes.Unavailable, "circuit breaker open for %s", backend)
+			}
+
+			callCtx, cancel := ctx, context.CancelFunc(func() {})
+			if policy.Timeout > 0 {
+				callCtx, cancel = context.WithTimeout(ctx, policy.Timeout)
+			}
+			err := invoker(callCtx, method, req, reply, cc, opts...)
+			cancel()
+			breaker.record(err)
+
+			if err == nil || !policy.Idempotent || !policy.retryable(err) || attempt >= policy.MaxAttempts {
+				return err
+			}
+
+			backendRetries.Add(backend, 1)
+			glog.Warningf("Retrying RPC method=%s; Attempt=%d; Error=%v;", method, attempt+1, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(policy.backoff(attempt)):
+			}
+		}
+	}
+}
+
+// splitMethod splits "/pkg.Service/Method" into the service and method name.
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return fullMethod, ""
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	name     string
+	policy   BreakerPolicy
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func (s *breakerSet) get(name string, policy BreakerPolicy) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	breaker, ok := s.breakers[name]
+	if !ok {
+		breaker = &circuitBreaker{name: name, policy: policy}
+		breaker.setState(breakerClosed)
+		s.breakers[name] = breaker
+	}
+	return breaker
+}
+
+// allow reports whether a call may go through, letting a single probe
+// through once the open timeout has elapsed.
+func (b *circuitBreaker) allow() bool {
+	if b.policy.FailureThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	if b.policy.FailureThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !isBackendFailure(err) {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.policy.FailureThreshold {
+		if b.state != breakerOpen {
+			glog.Warningf("Circuit breaker for %s opened after %d failures", b.name, b.failures)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	value := new(expvar.String)
+	value.Set(string(state))
+	breakerStates.Set(b.name, value)
+}
+
+// isBackendFailure reports whether the error means the backend is unhealthy,
+// as opposed to a rejected request.
+func isBackendFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/resolver"
+)
+
+// staticScheme resolves a comma separated list of host:port addresses,
+// looking up the host names in DNS, e.g. "atk:///backend-0:9090,backend-1:9090".
+const staticScheme = "atk"
+
+const defaultRefreshInterval = 30 * time.Second
+
+func init() {
+	registerResolver(staticScheme, func(scheme string, subConns int) resolver.Builder {
+		return &staticResolverBuilder{scheme: scheme, subConns: subConns}
+	})
+}
+
+// resolverBuild returns the builder of a scheme opening subConns connections to every address
+type resolverBuild func(scheme string, subConns int) resolver.Builder
+
+var (
+	resolverBuildsMu sync.Mutex
+	resolverBuilds   = make(map[string]resolverBuild)
+	subConnsSchemes  = make(map[string]bool)
+)
+
+// registerResolver registers the resolver of the scheme, and keeps its builder
+// for the schemes of subConnsScheme.
+func registerResolver(scheme string, build resolverBuild) {
+	resolverBuildsMu.Lock()
+	defer resolverBuildsMu.Unlock()
+	resolver.Register(build(scheme, 1))
+	resolverBuilds[scheme] = build
+}
+
+// subConnsScheme returns the scheme resolving the targets of the given one into
+// subConns connections to every address, e.g. "atk-2", registering it on first use.
+func subConnsScheme(scheme string, subConns int) string {
+	if subConns <= 1 {
+		return scheme
+	}
+	resolverBuildsMu.Lock()
+	defer resolverBuildsMu.Unlock()
+	build, ok := resolverBuilds[scheme]
+	if !ok {
+		return scheme
+	}
+	name := scheme + "-" + strconv.Itoa(subConns)
+	if !subConnsSchemes[name] {
+		resolver.Register(build(name, subConns))
+		subConnsSchemes[name] = true
+	}
+	return name
+}
+
+type staticResolverBuilder struct {
+	scheme   string
+	subConns int
+}
+
+func (b *staticResolverBuilder) Scheme() string {
+	return b.scheme
+}
+
+func (b *staticResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+	r := &staticResolver{
+		addrs:      strings.Split(target.Endpoint, ","),
+		subConns:   b.subConns,
+		cc:         cc,
+		resolved:   make(map[string][]string),
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	r.resolve()
+	go r.refresh(defaultRefreshInterval)
+	return r, nil
+}
+
+// staticResolver resolves the DNS names of the addresses periodically,
+// so replicas behind a headless service are picked up as they come and go.
+type staticResolver struct {
+	addrs      []string
+	subConns   int
+	cc         resolver.ClientConn
+	resolved   map[string][]string
+	resolveNow chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (r *staticResolver) ResolveNow(resolver.ResolveNowOption) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *staticResolver) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+func (r *staticResolver) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.resolve()
+		case <-r.resolveNow:
+			r.resolve()
+		}
+	}
+}
+
+// resolve looks up the addresses, an address which fails to resolve keeps
+// the IPs of its previous lookup, so a DNS outage doesn't drop the replicas.
+func (r *staticResolver) resolve() {
+	var resolved []string
+	for _, addr := range r.addrs {
+		addr = strings.TrimSpace(addr)
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			glog.Errorf("Invalid backend address %q: %v", addr, err)
+			continue
+		}
+		if net.ParseIP(host) != nil {
+			resolved = append(resolved, addr)
+			continue
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			glog.Errorf("Failed to resolve backend address %q, keeping %v: %v", addr, r.resolved[addr], err)
+			resolved = append(resolved, r.resolved[addr]...)
+			continue
+		}
+		hostAddrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			hostAddrs = append(hostAddrs, net.JoinHostPort(ip, port))
+		}
+		r.resolved[addr] = hostAddrs
+		resolved = append(resolved, hostAddrs...)
+	}
+	if len(resolved) == 0 {
+		glog.Errorf("No backend address of %v resolved", r.addrs)
+		return
+	}
+	r.cc.NewAddress(expandSubConns(resolved, r.subConns))
+}
+
+// expandSubConns returns every address n times, made distinct through
+// their metadata so the balancer opens a connection for each of them.
+func expandSubConns(addrs []string, n int) []resolver.Address {
+	if n < 1 {
+		n = 1
+	}
+	expanded := make([]resolver.Address, 0, len(addrs)*n)
+	for _, addr := range addrs {
+		for i := 0; i < n; i++ {
+			address := resolver.Address{Addr: addr}
+			if n > 1 {
+				address.Metadata = i
+			}
+			expanded = append(expanded, address)
+		}
+	}
+	return expanded
+}
@@ -27,6 +27,10 @@ require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/rakyll/statik v0.1.6
 	github.com/rs/cors v1.6.0
+	github.com/tidwall/pretty v1.2.2 // indirect
+	github.com/xdg/scram v0.0.1 // indirect
+	github.com/xdg/stringprep v1.0.1-0.20180714160509-73f8eece6fdc // indirect
+	go.mongodb.org/mongo-driver v1.1.0
 	golang.org/x/oauth2 v0.0.0-20190523182746-aaccbc9213b0
 	google.golang.org/grpc v1.21.0
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
@@ -0,0 +1,145 @@
+package atk
+
+import (
+	"expvar"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micro/go-log"
+
+	"github.com/lakstap/go-atk/database"
+	"github.com/lakstap/go-atk/database/config"
+	"github.com/lakstap/go-atk/secrets"
+)
+
+var (
+	// database config reloads, served on /debug/vars of the admin address
+	// of the service, see ATKGrpcServiceOption.AdminAddr
+	dbReloadSuccess   = expvar.NewInt("atk_db_reload_success")
+	dbReloadFailure   = expvar.NewInt("atk_db_reload_failure")
+	dbReloadLastError = expvar.NewString("atk_db_reload_last_error")
+)
+
+// DBSession returns the current session of the default database, which follows the
+// reloads of the database config file.
+func (e *ATKGrpcService) DBSession() *mdb.DatabaseSession {
+	return e.DB(config.DefaultName)
+}
+
+// DB returns the current session of the named database, e.g. svc.DB("reporting"),
+// or nil when the service has no such database.
+func (e *ATKGrpcService) DB(name string) *mdb.DatabaseSession {
+	session, _ := e.sessions.Load(name)
+	db, _ := session.(*mdb.DatabaseSession)
+	return db
+}
+
+// DBNames returns the names of the databases of the service.
+func (e *ATKGrpcService) DBNames() []string {
+	var names []string
+	e.sessions.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// setSession makes the session of the named database current and returns the previous one.
+func (e *ATKGrpcService) setSession(name string, session *mdb.DatabaseSession) *mdb.DatabaseSession {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := e.DB(name)
+	e.sessions.Store(name, session)
+	return old
+}
+
+// watchDBConfig dials a new session every time the named database changes in the config
+// file, the previous session is closed once the grace period is over.
+func (e *ATKGrpcService) watchDBConfig(path, name string, grace, secretRefresh time.Duration) error {
+	stop, err := config.WatchNamedConfig(path, name, func(dbConfig config.DBConfig, err error) {
+		if err == nil {
+			err = dbConfig.Validate()
+		}
+		var session *mdb.DatabaseSession
+		if err == nil {
+			session, err = mdb.DialWithRetry(dbConfig, e.dbDialOptions)
+		}
+		if err != nil {
+			dbReloadFailure.Add(1)
+			dbReloadLastError.Set(err.Error())
+			log.Logf("Failed to reload the %s configuration, keeping the current session: %v", name, err)
+			return
+		}
+
+		old := e.setSession(name, session)
+		e.watchSecrets(name, dbConfig, secretRefresh, grace)
+		dbReloadSuccess.Add(1)
+		log.Logf("Reloaded the %s configuration (%s)..", name, strings.Join(dbConfig.Addresses(), ","))
+		e.retireSession(old, grace)
+	})
+	if err != nil {
+		return err
+	}
+	e.addWatcher(stop)
+	return nil
+}
+
+// watchSecrets reconnects the named database when the secret files of its credentials
+// are rotated, replacing the previous secrets watcher of the database. The previous
+// session is closed once the grace period is over.
+func (e *ATKGrpcService) watchSecrets(name string, dbConfig config.DBConfig, interval, grace time.Duration) {
+	stop := secrets.WatchFiles(interval, func() {
+		rotated := dbConfig
+		if err := rotated.ResolveSecrets(); err != nil {
+			log.Logf("Failed to read the rotated %s credentials: %v", name, err)
+			return
+		}
+		session, err := mdb.DialWithRetry(rotated, e.dbDialOptions)
+		if err != nil {
+			log.Logf("Failed to connect with the rotated %s credentials: %v", name, err)
+			return
+		}
+		e.retireSession(e.setSession(name, session), grace)
+		log.Logf("Connected with the rotated %s credentials", name)
+	}, dbConfig.URI, dbConfig.UserName, dbConfig.Password)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if previous, ok := e.stopSecrets[name]; ok {
+		previous()
+	}
+	if e.stopSecrets == nil {
+		e.stopSecrets = make(map[string]func())
+	}
+	e.stopSecrets[name] = stop
+}
+
+// retireSession closes a replaced session once the grace period is over, except the deprecated
+// Session of the service which its callers keep using, it is closed with the service.
+func (e *ATKGrpcService) retireSession(old *mdb.DatabaseSession, grace time.Duration) {
+	if old == nil || old == e.Session {
+		return
+	}
+	time.AfterFunc(grace, old.Close)
+}
+
+func (e *ATKGrpcService) addWatcher(stop func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stops = append(e.stops, stop)
+}
+
+func (e *ATKGrpcService) stopWatchers() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, stop := range e.stops {
+		stop()
+	}
+	e.stops = nil
+	for _, stop := range e.stopSecrets {
+		stop()
+	}
+	e.stopSecrets = nil
+}
@@ -0,0 +1,146 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const redacted = "******"
+
+// MountDir is the directory the kubernetes secrets are mounted in,
+// "k8s:<secret>/<key>" reads the file MountDir/<secret>/<key>.
+var MountDir = "/etc/secrets"
+
+// Secret is a configuration value given either in plain text or as a reference
+// resolved at load time: "env:VAR", "file:/path" or "k8s:<secret>/<key>".
+// It never prints nor marshals its value.
+type Secret struct {
+	ref      string
+	value    string
+	resolved bool
+	plain    bool
+}
+
+// New returns a secret for the plain value or reference.
+func New(ref string) Secret {
+	return Secret{ref: ref}
+}
+
+// Plain returns a secret holding the value as is, never taken for a reference.
+func Plain(value string) Secret {
+	return Secret{ref: value, value: value, resolved: true, plain: true}
+}
+
+// Ref returns the plain value or reference the secret was configured with.
+func (s Secret) Ref() string {
+	return s.ref
+}
+
+// IsSet reports whether the secret was configured.
+func (s Secret) IsSet() bool {
+	return s.ref != ""
+}
+
+// IsReference reports whether the secret refers to an environment variable or file.
+func (s Secret) IsReference() bool {
+	kind, _ := s.parse()
+	return kind != ""
+}
+
+// Path returns the file holding the secret, empty when it isn't read from a file.
+func (s Secret) Path() string {
+	kind, name := s.parse()
+	switch kind {
+	case "file":
+		return name
+	case "k8s":
+		return filepath.Join(MountDir, filepath.FromSlash(name))
+	}
+	return ""
+}
+
+// Resolve reads the value the secret refers to.
+func (s *Secret) Resolve() error {
+	value, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.value = value
+	s.resolved = true
+	return nil
+}
+
+// Read returns the secret value, reading it when it was not resolved yet.
+func (s Secret) Read() (string, error) {
+	if s.resolved {
+		return s.value, nil
+	}
+	return s.read()
+}
+
+// Value returns the value of a secret already resolved, e.g. by the config loader.
+// An unresolved reference is read, empty when it can't be: use Read for its error.
+func (s Secret) Value() string {
+	value, _ := s.Read()
+	return value
+}
+
+func (s Secret) read() (string, error) {
+	kind, name := s.parse()
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", name)
+		}
+		return value, nil
+	case "file", "k8s":
+		data, err := ioutil.ReadFile(s.Path())
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return s.ref, nil
+}
+
+func (s Secret) parse() (string, string) {
+	if s.plain {
+		return "", s.ref
+	}
+	for _, kind := range []string{"env", "file", "k8s"} {
+		if strings.HasPrefix(s.ref, kind+":") {
+			return kind, strings.TrimPrefix(s.ref, kind+":")
+		}
+	}
+	return "", s.ref
+}
+
+// String redacts the secret, references are shown as they hold no secret themselves.
+func (s Secret) String() string {
+	if s.IsReference() || s.ref == "" {
+		return s.ref
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("secrets.Secret(%q)", s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	*s = New(ref)
+	return nil
+}
@@ -0,0 +1,58 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// WatchFiles polls the files behind the secrets, such as rotated kubernetes
+// secrets, and calls onChange when the content of one of them changed.
+// The returned function stops the polling.
+func WatchFiles(interval time.Duration, onChange func(), watched ...Secret) (stop func()) {
+	sums := make(map[string][sha256.Size]byte)
+	for _, secret := range watched {
+		if path := secret.Path(); path != "" {
+			sums[path] = fileSum(path)
+		}
+	}
+
+	done := make(chan struct{})
+	if len(sums) == 0 || interval <= 0 {
+		return func() {}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				changed := false
+				for path, sum := range sums {
+					if current := fileSum(path); current != sum {
+						sums[path] = current
+						changed = true
+					}
+				}
+				if changed {
+					glog.Infof("Secret files changed, reloading")
+					onChange()
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func fileSum(path string) [sha256.Size]byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
@@ -1,13 +1,17 @@
 package atk
 
 import (
-	"github.com/micro/go-log"
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
 
+	"github.com/micro/go-log"
 	"github.com/micro/go-micro"
 	"github.com/micro/go-grpc"
 	"github.com/micro/cli"
-	"github.com/lakstap/go-atk/database/config"
-	"strings"
+	atkconfig "github.com/lakstap/go-atk/config"
+	"sync"
 	"time"
 	"github.com/patrickmn/go-cache"
 
@@ -22,11 +26,21 @@ type ATKGrpcServiceOption struct {
 	// Version name for the service
 	Version string
 
-	// Type of GRPC Service ( Database )
+	// Type of GRPC Service, the registered service types joined by "+"
+	// e.g. "database" or "database+cache", see RegisterServiceType
 	ServiceType string
 
 	//Address GRPC Service binded
 	Address string
+
+	// AdminAddr is the address of the admin listener serving /debug/vars, e.g. the
+	// database reload metrics, off when empty. It has no auth, keep it on a private
+	// interface, e.g. "127.0.0.1:8092".
+	AdminAddr string
+
+	// Config is the loaded ATK configuration, when set the database settings
+	// are taken from it instead of the db_config_path file
+	Config *atkconfig.ATKConfig
 }
 
 // ATK Grpc Service
@@ -35,26 +49,70 @@ type ATKGrpcService struct {
 
 	Service micro.Service
 
+	// Session is the database session dialed at startup. It is kept open until the service
+	// closes, but doesn't follow the reloads of the config file nor the credential rotations.
+	// Deprecated: use DBSession(), which follows them
 	Session *mdb.DatabaseSession
 
 	ATKCache *cache.Cache
+
+	// service types, in the order they are initialized
+	types []namedServiceType
+
+	// set by the service types running a command instead of serving, e.g. the migrations
+	exitAfterInit bool
+
+	// current database sessions by name, see DB
+	sessions sync.Map
+
+	// dial options of the sessions redialed by the reloads, without retries
+	dbDialOptions mdb.DialOptions
+
+	mu          sync.Mutex
+	stops       []func()
+	stopSecrets map[string]func()
+}
+
+// InitError is returned when a service could not be initialized
+type InitError struct {
+	// Stage is the initialization step which failed, "config" or the
+	// name of the service type
+	Stage string
+	Err   error
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("failed to initialize the service (%s): %v", e.Stage, e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *InitError) Cause() error {
+	return e.Err
 }
 
 // New ATK GRPC Service returns a new grpc with default values.
-func NewATKGrpcService(opts ATKGrpcServiceOption) *ATKGrpcService {
+func NewATKGrpcService(opts ATKGrpcServiceOption) (*ATKGrpcService, error) {
+
+	cacheExpiration, cacheCleanup := 5*time.Minute, 10*time.Minute
+	if opts.Config != nil {
+		cacheExpiration = time.Duration(opts.Config.Cache.DefaultExpiration)
+		cacheCleanup = time.Duration(opts.Config.Cache.CleanupInterval)
+		applyLoggingConfig(opts.Config.Logging)
+	}
+
+	types := newServiceTypes(opts.ServiceType)
+	var flags []cli.Flag
+	for _, serviceType := range types {
+		flags = append(flags, serviceType.Flags()...)
+	}
 
 	atkService := &ATKGrpcService{
 		Options:  opts,
-		ATKCache: cache.New(5*time.Minute, 10*time.Minute),
+		ATKCache: cache.New(cacheExpiration, cacheCleanup),
+		types:    types,
 		Service: grpc.NewService(
 			micro.Address(opts.Address),
-			micro.Flags(
-				cli.StringFlag{
-					Name:  "db_config_path",
-					Usage: "JSON  file path for database configuration",
-					Value: "config/config.json",
-				},
-			),
+			micro.Flags(flags...),
 			micro.Name(opts.ServiceName), //"go.micro.srv.atk.Grpc.project"
 			micro.Version(opts.Version),
 			//gsrv.Options(gogrpc.UnaryInterceptor(unaryInterceptor)),
@@ -62,38 +120,62 @@ func NewATKGrpcService(opts ATKGrpcServiceOption) *ATKGrpcService {
 		),
 	}
 
-	// Initialize service based on the type
-	if strings.EqualFold(opts.ServiceType, "database") {
+	// Initialize the service types, in the order they are listed
+	var initErr error
+	if len(types) > 0 {
 		atkService.Service.Init(
 			micro.Action(func(c *cli.Context) {
-				log.Log("Reading the config data from the configuration file..")
-				dbConfigPath := c.String("db_config_path")
-				if len(dbConfigPath) > 0 {
-					log.Log("Parsing the Database config file...", dbConfigPath)
-					// Read the Config
-					dbConfig, err := config.ReadConfig(dbConfigPath)
-					if err != nil {
-						log.Fatal(err)
-					}
-					log.Logf("Read the configuration file (%s)..", dbConfig.Address)
-					// create the session
-					atkService.Session, err = mdb.GetDBSession(dbConfig)
-					if err != nil {
-						log.Fatal(err)
+				for _, serviceType := range types {
+					if initErr = serviceType.Init(atkService, c); initErr != nil {
+						if _, ok := initErr.(*InitError); !ok {
+							initErr = &InitError{Stage: serviceType.name, Err: initErr}
+						}
+						return
 					}
 				}
 			}),
 		)
 	}
+	if initErr != nil {
+		atkService.Close()
+		return nil, initErr
+	}
 
-	return atkService
+	return atkService, nil
 }
 
 func (e *ATKGrpcService) RunATKGrpcService() error {
+	defer e.Close()
+	if e.exitAfterInit {
+		return nil
+	}
+
+	if e.Options.AdminAddr != "" {
+		stop := e.runAdmin()
+		defer stop()
+	}
 
 	// Run service
-	if err := e.Service.Run(); err != nil {
-		log.Fatal(err)
+	return e.Service.Run()
+}
+
+// runAdmin serves the expvar metrics on the admin address, until the returned func is called.
+func (e *ATKGrpcService) runAdmin() func() {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	s := &http.Server{
+		Addr:    e.Options.AdminAddr,
+		Handler: mux,
+	}
+	go func() {
+		log.Logf("Admin server listening at the address %s", e.Options.AdminAddr)
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			log.Logf("Failed to listen and serve the admin server: %v", err)
+		}
+	}()
+	return func() {
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Logf("Failed to shutdown the admin server: %v", err)
+		}
 	}
-	return nil
 }
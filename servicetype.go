@@ -0,0 +1,129 @@
+package atk
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micro/cli"
+	"github.com/micro/go-log"
+)
+
+// ServiceType sets up a resource of a service, e.g. its database or cache.
+// Several types can be combined on one service, e.g. "database+cache".
+type ServiceType interface {
+	// Flags returns the command line flags of the type
+	Flags() []cli.Flag
+
+	// Init sets the resource up from the flags and the config section of the type
+	Init(svc *ATKGrpcService, c *cli.Context) error
+
+	// Health returns an error when the resource is not usable
+	Health() error
+
+	// Close releases the resource
+	Close() error
+}
+
+// ServiceTypeFactory returns a new instance of a service type
+type ServiceTypeFactory func() ServiceType
+
+var (
+	serviceTypesMu sync.RWMutex
+	serviceTypes   = make(map[string]ServiceTypeFactory)
+)
+
+// RegisterServiceType makes a service type available by name to ATKGrpcServiceOption.ServiceType.
+// It panics when the name is registered twice.
+func RegisterServiceType(name string, factory ServiceTypeFactory) {
+	serviceTypesMu.Lock()
+	defer serviceTypesMu.Unlock()
+
+	name = strings.ToLower(name)
+	if _, ok := serviceTypes[name]; ok {
+		panic("atk: service type " + name + " registered twice")
+	}
+	serviceTypes[name] = factory
+}
+
+// ServiceTypes returns the names of the registered service types.
+func ServiceTypes() []string {
+	serviceTypesMu.RLock()
+	defer serviceTypesMu.RUnlock()
+
+	return registeredNamesLocked()
+}
+
+type namedServiceType struct {
+	name string
+	ServiceType
+}
+
+// newServiceTypes creates the types listed in the "+" or "," separated service type.
+// The unknown types are skipped with a warning, as the service types other than
+// "database" used to be ignored.
+func newServiceTypes(serviceType string) []namedServiceType {
+	serviceTypesMu.RLock()
+	defer serviceTypesMu.RUnlock()
+
+	var types []namedServiceType
+	for _, name := range strings.FieldsFunc(strings.ToLower(serviceType), func(r rune) bool {
+		return r == '+' || r == ','
+	}) {
+		name = strings.TrimSpace(name)
+		factory, ok := serviceTypes[name]
+		if !ok {
+			log.Logf("Skipping the unknown service type %q, registered types are %v", name, registeredNamesLocked())
+			continue
+		}
+		types = append(types, namedServiceType{name: name, ServiceType: factory()})
+	}
+	return types
+}
+
+// registeredNamesLocked returns the registered names, serviceTypesMu must be held.
+func registeredNamesLocked() []string {
+	names := make([]string, 0, len(serviceTypes))
+	for name := range serviceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConfigSection reads the "services.<name>" section of the ATK config into v,
+// v is left untouched when there is no such section.
+func (e *ATKGrpcService) ConfigSection(name string, v interface{}) error {
+	if e.Options.Config == nil {
+		return nil
+	}
+	section, ok := e.Options.Config.Services[name]
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(section, v)
+}
+
+// Health returns the error of every service type which is not healthy, by type name.
+func (e *ATKGrpcService) Health() map[string]error {
+	unhealthy := make(map[string]error)
+	for _, serviceType := range e.types {
+		if err := serviceType.Health(); err != nil {
+			unhealthy[serviceType.name] = err
+		}
+	}
+	return unhealthy
+}
+
+// Close releases the resources of the service types, in reverse order of initialization.
+func (e *ATKGrpcService) Close() error {
+	e.stopWatchers()
+	var firstErr error
+	for i := len(e.types) - 1; i >= 0; i-- {
+		if err := e.types[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
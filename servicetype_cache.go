@@ -0,0 +1,63 @@
+package atk
+
+import (
+	"time"
+
+	"github.com/micro/cli"
+	"github.com/patrickmn/go-cache"
+
+	atkconfig "github.com/lakstap/go-atk/config"
+)
+
+func init() {
+	RegisterServiceType("cache", func() ServiceType { return &cacheServiceType{} })
+}
+
+// cacheServiceType sizes the in-memory ATKCache of the service from its flags
+// or the "services.cache" config section
+type cacheServiceType struct {
+	svc *ATKGrpcService
+}
+
+func (t *cacheServiceType) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.DurationFlag{
+			Name:  "cache_default_expiration",
+			Usage: "Default expiration of the ATKCache items",
+			Value: 5 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "cache_cleanup_interval",
+			Usage: "How often the expired ATKCache items are deleted",
+			Value: 10 * time.Minute,
+		},
+	}
+}
+
+func (t *cacheServiceType) Init(svc *ATKGrpcService, c *cli.Context) error {
+	t.svc = svc
+
+	cacheConfig := atkconfig.CacheConfig{
+		DefaultExpiration: atkconfig.Duration(c.Duration("cache_default_expiration")),
+		CleanupInterval:   atkconfig.Duration(c.Duration("cache_cleanup_interval")),
+	}
+	if svc.Options.Config != nil && !c.IsSet("cache_default_expiration") && !c.IsSet("cache_cleanup_interval") {
+		cacheConfig = svc.Options.Config.Cache
+	}
+	if err := svc.ConfigSection("cache", &cacheConfig); err != nil {
+		return &InitError{Stage: "cache", Err: err}
+	}
+	svc.ATKCache = cache.New(time.Duration(cacheConfig.DefaultExpiration), time.Duration(cacheConfig.CleanupInterval))
+	return nil
+}
+
+func (t *cacheServiceType) Health() error {
+	return nil
+}
+
+func (t *cacheServiceType) Close() error {
+	if t.svc != nil {
+		t.svc.ATKCache.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package atk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/micro/cli"
+	"github.com/micro/go-log"
+
+	"github.com/lakstap/go-atk/database"
+	"github.com/lakstap/go-atk/database/config"
+)
+
+func init() {
+	RegisterServiceType("database", func() ServiceType { return &databaseServiceType{} })
+}
+
+const (
+	// healthTimeout bounds the ping of the databases
+	healthTimeout = 5 * time.Second
+
+	// indexTimeout bounds the index creation at startup
+	indexTimeout = 10 * time.Minute
+)
+
+// databaseServiceType dials the Mongo session of the service
+type databaseServiceType struct {
+	svc *ATKGrpcService
+}
+
+func (t *databaseServiceType) Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "db_config_path",
+			Usage: "JSON  file path for database configuration",
+			Value: "config/config.json",
+		},
+		cli.BoolTFlag{
+			Name:  "db_config_watch",
+			Usage: "Reload the database session when the database config file changes",
+		},
+		cli.DurationFlag{
+			Name:  "db_reload_grace_period",
+			Usage: "How long the previous database session stays open after a reload",
+			Value: 30 * time.Second,
+		},
+		cli.IntFlag{
+			Name:  "db_dial_retries",
+			Usage: "Number of retries when the database session can't be dialed",
+			Value: mdb.DefaultDialOptions.Retries,
+		},
+		cli.DurationFlag{
+			Name:  "db_dial_backoff",
+			Usage: "Wait before the first retry of the database dial, doubled after every failure",
+			Value: mdb.DefaultDialOptions.Backoff,
+		},
+		cli.BoolTFlag{
+			Name:  "db_mgo_compat",
+			Usage: "Dial an mgo session along with every database session, best effort, for the services still using the mgo methods",
+		},
+		cli.DurationFlag{
+			Name:  "secret_refresh_interval",
+			Usage: "How often the secret files of the database credentials are checked for rotation",
+			Value: time.Minute,
+		},
+		cli.BoolTFlag{
+			Name:  "db_ensure_indexes",
+			Usage: "Create the declared indexes of the default database at startup",
+		},
+		cli.BoolFlag{
+			Name:  "db_indexes_dry_run",
+			Usage: "Only log the differences between the declared and the existing indexes",
+		},
+		cli.BoolFlag{
+			Name:  "db_recreate_indexes",
+			Usage: "Drop and create again the indexes which differ from their declaration, they are only logged otherwise",
+		},
+		cli.BoolFlag{
+			Name:  "db_drop_unmanaged_indexes",
+			Usage: "Drop the indexes which are not declared, in the collections with declared indexes",
+		},
+		cli.StringFlag{
+			Name: "db_migrate",
+			Usage: "Migrations of the default database: \"auto\" applies them at startup, " +
+				"\"status\", \"up\" and \"down-to\" run and exit without serving",
+		},
+		cli.IntFlag{
+			Name:  "db_migrate_to",
+			Usage: "Version the migrations are reverted to by -db_migrate=down-to, required by it",
+		},
+	}
+}
+
+// databaseTypeConfig is the "services.database" section of the ATK config
+type databaseTypeConfig struct {
+	// Indexes of the default database by collection, besides the ones of mdb.RegisterIndexes
+	Indexes map[string][]mdb.Index `json:"indexes"`
+}
+
+// Init dials the sessions of the databases of the config, or of the db_config_path file.
+// The default database is the "database" entry, the others are reachable with svc.DB(name).
+func (t *databaseServiceType) Init(svc *ATKGrpcService, c *cli.Context) error {
+	t.svc = svc
+	dialOptions := mdb.DialOptions{
+		Retries:         c.Int("db_dial_retries"),
+		Backoff:         c.Duration("db_dial_backoff"),
+		MaxBackoff:      mdb.DefaultDialOptions.MaxBackoff,
+		NoLegacyAdapter: !c.BoolT("db_mgo_compat"),
+	}
+	svc.dbDialOptions = mdb.DialOptions{NoLegacyAdapter: dialOptions.NoLegacyAdapter}
+
+	dbConfigs := make(map[string]config.DBConfig)
+	dbConfigPath := ""
+	if svc.Options.Config != nil && (hasDatabase(svc.Options.Config.Database) || len(svc.Options.Config.Databases) > 0) {
+		log.Log("Using the database configuration..")
+		if hasDatabase(svc.Options.Config.Database) {
+			dbConfigs[config.DefaultName] = svc.Options.Config.Database
+		}
+		for name, dbConfig := range svc.Options.Config.Databases {
+			dbConfigs[name] = dbConfig
+		}
+	} else {
+		log.Log("Reading the config data from the configuration file..")
+		dbConfigPath = c.String("db_config_path")
+		if len(dbConfigPath) == 0 {
+			return nil
+		}
+		log.Log("Parsing the Database config file...", dbConfigPath)
+		// Read the Config
+		var err error
+		dbConfigs, err = config.ReadConfigs(dbConfigPath)
+		if err != nil {
+			return &InitError{Stage: "config", Err: err}
+		}
+	}
+
+	names := make([]string, 0, len(dbConfigs))
+	for name := range dbConfigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dbConfig := dbConfigs[name]
+		log.Logf("Dialing the %s database (%s)..", name, strings.Join(dbConfig.Addresses(), ","))
+		// create the session
+		session, err := mdb.DialWithRetry(dbConfig, dialOptions)
+		if err != nil {
+			return &InitError{Stage: "database " + name, Err: err}
+		}
+		if name == config.DefaultName {
+			svc.Session = session
+		}
+		svc.setSession(name, session)
+		svc.watchSecrets(name, dbConfig, c.Duration("secret_refresh_interval"), c.Duration("db_reload_grace_period"))
+		if dbConfigPath != "" && c.BoolT("db_config_watch") {
+			if err := svc.watchDBConfig(dbConfigPath, name, c.Duration("db_reload_grace_period"), c.Duration("secret_refresh_interval")); err != nil {
+				log.Logf("Failed to watch the %s config: %v", name, err)
+			}
+		}
+	}
+
+	if svc.DBSession() != nil && c.String("db_migrate") != "" {
+		if err := t.migrate(c); err != nil {
+			return &InitError{Stage: "migrations", Err: err}
+		}
+	}
+	if svc.DBSession() != nil && c.BoolT("db_ensure_indexes") {
+		if err := t.ensureIndexes(c); err != nil {
+			return &InitError{Stage: "indexes", Err: err}
+		}
+	}
+	return nil
+}
+
+// migrate runs the migrations command, the commands other than "auto" make the service exit.
+func (t *databaseServiceType) migrate(c *cli.Context) error {
+	command := c.String("db_migrate")
+	ctx := context.Background()
+	migrator := mdb.NewMigrator(t.svc.DBSession())
+
+	switch command {
+	case "auto", "up":
+		done, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		log.Logf("Applied %d migration(s) %v", len(done), done)
+	case "down-to":
+		// 0 would revert every migration, it must be asked for
+		if !c.IsSet("db_migrate_to") {
+			return errors.New("-db_migrate=down-to requires -db_migrate_to=<version>")
+		}
+		done, err := migrator.DownTo(ctx, int64(c.Int("db_migrate_to")))
+		if err != nil {
+			return err
+		}
+		log.Logf("Reverted %d migration(s) %v", len(done), done)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				log.Logf("%d applied %s  %s", status.Version, status.AppliedAt.Format(time.RFC3339), status.Description)
+			} else {
+				log.Logf("%d pending  %s", status.Version, status.Description)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrations command %q, expected auto, status, up or down-to", command)
+	}
+	if command != "auto" {
+		t.svc.exitAfterInit = true
+	}
+	return nil
+}
+
+// ensureIndexes creates the indexes declared in code and in the config in the default database.
+func (t *databaseServiceType) ensureIndexes(c *cli.Context) error {
+	declared := mdb.RegisteredIndexes()
+	typeConfig := databaseTypeConfig{}
+	if err := t.svc.ConfigSection("database", &typeConfig); err != nil {
+		return err
+	}
+	for collection, indexes := range typeConfig.Indexes {
+		declared[collection] = append(declared[collection], indexes...)
+	}
+	if len(declared) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancel()
+	opts := mdb.EnsureOptions{
+		DryRun:        c.Bool("db_indexes_dry_run"),
+		DropUnmanaged: c.Bool("db_drop_unmanaged_indexes"),
+		Recreate:      c.Bool("db_recreate_indexes"),
+	}
+	changes, err := t.svc.DBSession().EnsureIndexes(ctx, declared, opts)
+	for _, change := range changes {
+		if change.Action == "changed" {
+			log.Logf("The index %s.%s differs from its declaration and is kept as is, "+
+				"-db_recreate_indexes drops and creates it again", change.Collection, change.Index)
+		} else if opts.DryRun {
+			log.Logf("Index change (dry run): %s", change)
+		} else {
+			log.Logf("Index change: %s", change)
+		}
+	}
+	return err
+}
+
+// hasDatabase reports whether the config sets a database up, by address or uri
+func hasDatabase(dbConfig config.DBConfig) bool {
+	return dbConfig.URI.IsSet() || len(dbConfig.Addresses()) > 0
+}
+
+func (t *databaseServiceType) Health() error {
+	if t.svc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	for _, name := range t.svc.DBNames() {
+		if err := t.svc.DB(name).PingContext(ctx); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (t *databaseServiceType) Close() error {
+	if t.svc == nil {
+		return nil
+	}
+	for _, name := range t.svc.DBNames() {
+		if session := t.svc.DB(name); session != t.svc.Session {
+			session.Close()
+		}
+	}
+	if t.svc.Session != nil {
+		t.svc.Session.Close()
+	}
+	return nil
+}
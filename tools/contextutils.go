@@ -3,31 +3,69 @@ package tools
 import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc"
 	"strings"
 )
 
 /**
- * Get the User Id conext from the Metadata
+ * Get the User Id conext from the Metadata, empty when the request has none
  */
 func GetUIDFromContext(ctx context.Context) (string, error) {
-	// retrieve incoming metadata
-	md, ok := metadata.FromIncomingContext(ctx)
-	if ok {
-		// get the first (and presumably only) user ID from the request metadata
-		userID := md.Get("User")
-		return userID[0], nil
-	}
-	return "", nil
+	// get the first (and presumably only) user ID from the request metadata
+	userID, _ := GetMetadataFromContext(ctx, "User")
+	return userID, nil
 }
 
 
 func GetIsAdminStatusFromContext(ctx context.Context) (bool, error) {
-	// retrieve incoming metadata
+	IsAdmin, _ := GetMetadataFromContext(ctx, "IsAdmin")
+	return strings.EqualFold(IsAdmin, "true"), nil
+}
+
+/**
+ * Get the first value of a metadata key forwarded by the gateway
+ */
+func GetMetadataFromContext(ctx context.Context, key string) (string, bool) {
 	md, ok := metadata.FromIncomingContext(ctx)
-	if ok {
-		// get the first (and presumably only) user ID from the request metadata
-		IsAdmin := md.Get("IsAdmin")
-		return strings.EqualFold(IsAdmin[0], "true"), nil
+	if !ok {
+		return "", false
 	}
-	return false, nil
+	values := md.Get(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+/**
+ * Get the address of the calling client forwarded by the gateway
+ */
+func GetClientIPFromContext(ctx context.Context) string {
+	ip, _ := GetMetadataFromContext(ctx, "Client-IP")
+	return ip
+}
+
+/**
+ * Get the id of the last event a reconnecting Server-Sent Events client received,
+ * e.g. the resume token of a change stream
+ */
+func GetLastEventIDFromContext(ctx context.Context) string {
+	id, _ := GetMetadataFromContext(ctx, "Last-Event-ID")
+	return id
+}
+
+/**
+ * Set a response header, returned to HTTP clients by the gateway when the key is
+ * in its outgoing allowlist, as Grpc-Metadata-<key> otherwise.
+ */
+func SetResponseHeader(ctx context.Context, key, value string) error {
+	return grpc.SetHeader(ctx, metadata.Pairs(key, value))
+}
+
+/**
+ * Set a response trailer, returned to HTTP clients as Grpc-Trailer-<key>
+ * when the request carries "TE: trailers".
+ */
+func SetResponseTrailer(ctx context.Context, key, value string) error {
+	return grpc.SetTrailer(ctx, metadata.Pairs(key, value))
 }
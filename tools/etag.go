@@ -0,0 +1,44 @@
+package tools
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	etagKey    = "ETag"
+	ifMatchKey = "If-Match"
+)
+
+/**
+ * Set the version of the returned document as the ETag response header, e.g. "3"
+ */
+func SetETag(ctx context.Context, version int64) error {
+	return SetResponseHeader(ctx, etagKey, strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+/**
+ * Get the document version the client expects from the If-Match header forwarded by the gateway.
+ * It reports false when there is no If-Match or it is "*", any version. Weak ETags are accepted,
+ * a value which is not a version is an InvalidArgument error.
+ */
+func IfMatchVersion(ctx context.Context) (int64, bool, error) {
+	value, ok := GetMetadataFromContext(ctx, ifMatchKey)
+	value = strings.TrimSpace(value)
+	if !ok || value == "" || value == "*" {
+		return 0, false, nil
+	}
+	etag := strings.TrimPrefix(value, "W/")
+	if unquoted, err := strconv.Unquote(etag); err == nil {
+		etag = unquoted
+	}
+	version, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false, status.Errorf(codes.InvalidArgument, "invalid If-Match %q", value)
+	}
+	return version, true, nil
+}
@@ -0,0 +1,344 @@
+package tools
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DocumentNaming tells how the struct fields are named in the Mongo documents
+type DocumentNaming int
+
+const (
+	// BSONNaming uses the bson tag of the fields, their lowercased name otherwise as the driver does
+	BSONNaming DocumentNaming = iota
+
+	// JSONNaming uses the json tag of the fields, e.g. the proto field names of the generated structs
+	JSONNaming
+)
+
+// fullMaskPath selects every field, as an empty mask does
+const fullMaskPath = "*"
+
+// MongoProjection returns the projection document selecting the fields of the mask in the
+// documents of model, e.g. bson.M{"name": 1, "owner.id": 1}. It returns nil, every field,
+// for an empty mask. Unknown and overlapping paths, e.g. "owner" and "owner.id", are rejected
+// with InvalidArgument.
+func MongoProjection(fm *field_mask.FieldMask, model interface{}, naming DocumentNaming) (bson.M, error) {
+	if isFullMask(fm) {
+		return nil, nil
+	}
+	fields, err := resolveMaskPaths(reflect.TypeOf(model), fm.GetPaths(), naming)
+	if err != nil {
+		return nil, err
+	}
+	projection := bson.M{}
+	for _, field := range fields {
+		projection[field.document] = 1
+	}
+	return projection, nil
+}
+
+// MongoUpdate returns the update document writing the fields of the mask from src:
+// "$set" for the fields holding a value, zero values included, "$unset" for the nil ones.
+// Every field of src but _id is written for an empty mask, the zero values being unset.
+// The nested values are named as the paths are. Unknown and overlapping paths are rejected
+// with InvalidArgument.
+func MongoUpdate(fm *field_mask.FieldMask, src interface{}, naming DocumentNaming) (bson.M, error) {
+	paths := fm.GetPaths()
+	fullMask := isFullMask(fm)
+	if fullMask {
+		paths = topLevelPaths(reflect.TypeOf(src), naming)
+	}
+
+	fields, err := resolveMaskPaths(reflect.TypeOf(src), paths, naming)
+	if err != nil {
+		return nil, err
+	}
+	set, unset := bson.M{}, bson.M{}
+	for _, field := range fields {
+		if fullMask && field.document == "_id" {
+			continue
+		}
+		value, ok := field.value(reflect.ValueOf(src))
+		if !ok || isNilValue(value) || (fullMask && isZeroValue(value)) {
+			unset[field.document] = ""
+		} else {
+			set[field.document] = documentValue(value, naming)
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+func isFullMask(fm *field_mask.FieldMask) bool {
+	paths := fm.GetPaths()
+	return len(paths) == 0 || (len(paths) == 1 && paths[0] == fullMaskPath)
+}
+
+// maskField is a path of a mask resolved against a struct type
+type maskField struct {
+	// document is the dotted path of the field in the Mongo documents
+	document string
+
+	// steps to the field: struct field indexes, or map keys
+	steps []maskStep
+}
+
+type maskStep struct {
+	index int
+	key   string
+	isKey bool
+}
+
+// value returns the value of the field in v, false when a pointer on the way is nil.
+func (f maskField) value(v reflect.Value) (reflect.Value, bool) {
+	for _, step := range f.steps {
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		if step.isKey {
+			v = v.MapIndex(reflect.ValueOf(step.key).Convert(v.Type().Key()))
+			if !v.IsValid() {
+				return reflect.Value{}, false
+			}
+		} else {
+			v = v.Field(step.index)
+		}
+	}
+	return v, true
+}
+
+// resolveMaskPaths resolves the paths of a mask, rejecting a path inside another one:
+// Mongo refuses to update or project both.
+func resolveMaskPaths(t reflect.Type, paths []string, naming DocumentNaming) ([]maskField, error) {
+	fields := make([]maskField, 0, len(paths))
+	for _, path := range paths {
+		field, err := resolveMaskPath(t, path, naming)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range fields {
+			if strings.HasPrefix(field.document, other.document+".") || strings.HasPrefix(other.document, field.document+".") {
+				return nil, status.Errorf(codes.InvalidArgument, "overlapping field mask paths %q and %q", other.document, field.document)
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// resolveMaskPath finds the field of a dotted mask path, its segments being matched
+// against the proto, json and bson names and the Go names of the struct fields.
+func resolveMaskPath(t reflect.Type, path string, naming DocumentNaming) (maskField, error) {
+	field := maskField{}
+	var document []string
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" || strings.HasPrefix(segment, "$") {
+			return field, invalidMaskPath(path)
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			index, name, ok := findMaskField(t, segment, naming)
+			if !ok {
+				return field, invalidMaskPath(path)
+			}
+			field.steps = append(field.steps, maskStep{index: index})
+			document = append(document, name)
+			t = t.Field(index).Type
+		case reflect.Map:
+			if t.Key().Kind() != reflect.String {
+				return field, invalidMaskPath(path)
+			}
+			field.steps = append(field.steps, maskStep{key: segment, isKey: true})
+			document = append(document, segment)
+			t = t.Elem()
+		default:
+			// lists and values have no sub fields
+			return field, invalidMaskPath(path)
+		}
+	}
+	field.document = strings.Join(document, ".")
+	return field, nil
+}
+
+// findMaskField returns the index and document name of the struct field named segment.
+func findMaskField(t reflect.Type, segment string, naming DocumentNaming) (int, string, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" || strings.HasPrefix(structField.Name, "XXX_") {
+			continue
+		}
+		name := documentName(structField, naming)
+		if name == "" {
+			continue
+		}
+		if segment == name || segment == tagName(structField, "json") || segment == protoName(structField) ||
+			strings.EqualFold(segment, structField.Name) {
+			return i, name, true
+		}
+	}
+	return 0, "", false
+}
+
+// topLevelPaths returns the paths of every field of the struct type.
+func topLevelPaths(t reflect.Type, naming DocumentNaming) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var paths []string
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if structField.PkgPath != "" || strings.HasPrefix(structField.Name, "XXX_") {
+			continue
+		}
+		if name := documentName(structField, naming); name != "" {
+			paths = append(paths, name)
+		}
+	}
+	return paths
+}
+
+// documentName returns the name of the field in the documents, empty when it is not stored.
+func documentName(structField reflect.StructField, naming DocumentNaming) string {
+	tag := "bson"
+	if naming == JSONNaming {
+		tag = "json"
+	}
+	if structField.Tag.Get(tag) == "-" {
+		return ""
+	}
+	if name := tagName(structField, tag); name != "" {
+		return name
+	}
+	if naming == JSONNaming {
+		return structField.Name
+	}
+	return strings.ToLower(structField.Name)
+}
+
+func tagName(structField reflect.StructField, tag string) string {
+	name := strings.Split(structField.Tag.Get(tag), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// protoName returns the "name=" of the protobuf tag of the generated structs.
+func protoName(structField reflect.StructField) string {
+	for _, part := range strings.Split(structField.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return strings.TrimPrefix(part, "name=")
+		}
+	}
+	return ""
+}
+
+// documentValue returns the value written for a field. The driver names the fields of
+// the structs after their bson tags, the nested structs are turned into documents
+// named after their json tags with JSONNaming.
+func documentValue(v reflect.Value, naming DocumentNaming) interface{} {
+	if naming != JSONNaming {
+		return v.Interface()
+	}
+	return jsonDocumentValue(v)
+}
+
+var (
+	timeType           = reflect.TypeOf(time.Time{})
+	bsonMarshalerType  = reflect.TypeOf((*bson.Marshaler)(nil)).Elem()
+	valueMarshalerType = reflect.TypeOf((*bson.ValueMarshaler)(nil)).Elem()
+)
+
+func jsonDocumentValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	if t == timeType || t.Implements(bsonMarshalerType) || t.Implements(valueMarshalerType) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return jsonDocumentValue(v.Elem())
+	case reflect.Struct:
+		doc := bson.D{}
+		for i := 0; i < t.NumField(); i++ {
+			structField := t.Field(i)
+			if structField.PkgPath != "" || strings.HasPrefix(structField.Name, "XXX_") {
+				continue
+			}
+			name := documentName(structField, JSONNaming)
+			if name == "" {
+				continue
+			}
+			field := v.Field(i)
+			if strings.Contains(structField.Tag.Get("json"), ",omitempty") && isZeroValue(field) {
+				continue
+			}
+			doc = append(doc, bson.E{Key: name, Value: jsonDocumentValue(field)})
+		}
+		return doc
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 || (v.Kind() == reflect.Slice && v.IsNil()) {
+			return v.Interface()
+		}
+		values := make(bson.A, v.Len())
+		for i := range values {
+			values[i] = jsonDocumentValue(v.Index(i))
+		}
+		return values
+	case reflect.Map:
+		if v.IsNil() || t.Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		doc := bson.M{}
+		for _, key := range v.MapKeys() {
+			doc[key.String()] = jsonDocumentValue(v.MapIndex(key))
+		}
+		return doc
+	}
+	return v.Interface()
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil() || (v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.Len() == 0)
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func invalidMaskPath(path string) error {
+	return status.Errorf(codes.InvalidArgument, "invalid field mask path %q", path)
+}
@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testMaskOwner struct {
+	UserID string `protobuf:"bytes,1,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty" bson:"uid"`
+	Email  string `protobuf:"bytes,2,opt,name=email,proto3" json:"email,omitempty"`
+}
+
+type testMaskProject struct {
+	ID     string            `protobuf:"bytes,1,opt,name=id,proto3" json:"_id,omitempty" bson:"_id"`
+	Name   string            `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Count  int32             `protobuf:"varint,3,opt,name=count,proto3" json:"count,omitempty"`
+	Owner  *testMaskOwner    `protobuf:"bytes,4,opt,name=owner,proto3" json:"owner,omitempty"`
+	Labels map[string]string `protobuf:"bytes,5,rep,name=labels,proto3" json:"labels,omitempty"`
+	Secret string            `json:"-" bson:"-"`
+}
+
+func testMask(paths ...string) *field_mask.FieldMask {
+	return &field_mask.FieldMask{Paths: paths}
+}
+
+func TestMongoProjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		mask   *field_mask.FieldMask
+		naming DocumentNaming
+		want   bson.M
+	}{
+		{"empty mask", testMask(), BSONNaming, nil},
+		{"full mask", testMask("*"), BSONNaming, nil},
+		{"top level", testMask("name", "count"), BSONNaming, bson.M{"name": 1, "count": 1}},
+		{"id", testMask("id"), BSONNaming, bson.M{"_id": 1}},
+		{"nested bson", testMask("owner.user_id"), BSONNaming, bson.M{"owner.uid": 1}},
+		{"nested json", testMask("owner.userId"), JSONNaming, bson.M{"owner.user_id": 1}},
+		{"map key", testMask("labels.env"), BSONNaming, bson.M{"labels.env": 1}},
+		{"same path twice", testMask("name", "name"), BSONNaming, bson.M{"name": 1}},
+		{"sibling paths", testMask("owner.user_id", "owner.email"), BSONNaming, bson.M{"owner.uid": 1, "owner.email": 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MongoProjection(test.mask, testMaskProject{}, test.naming)
+			if err != nil {
+				t.Fatalf("MongoProjection(%v) failed: %v", test.mask.GetPaths(), err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("MongoProjection(%v) = %#v, want %#v", test.mask.GetPaths(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestMongoUpdate(t *testing.T) {
+	project := testMaskProject{
+		ID:     "p1",
+		Name:   "demo",
+		Owner:  &testMaskOwner{UserID: "u1"},
+		Secret: "s",
+	}
+	tests := []struct {
+		name   string
+		mask   *field_mask.FieldMask
+		src    testMaskProject
+		naming DocumentNaming
+		want   bson.M
+	}{
+		{"set", testMask("name"), project, BSONNaming, bson.M{"$set": bson.M{"name": "demo"}}},
+		{"zero value set", testMask("count"), project, BSONNaming, bson.M{"$set": bson.M{"count": int32(0)}}},
+		{"nil unset", testMask("labels"), project, BSONNaming, bson.M{"$unset": bson.M{"labels": ""}}},
+		{"nested", testMask("owner.user_id"), project, BSONNaming, bson.M{"$set": bson.M{"owner.uid": "u1"}}},
+		{"nested under nil", testMask("owner.email"), testMaskProject{}, BSONNaming, bson.M{"$unset": bson.M{"owner.email": ""}}},
+		{"explicit id", testMask("id"), project, BSONNaming, bson.M{"$set": bson.M{"_id": "p1"}}},
+		{"nested struct bson", testMask("owner"), project, BSONNaming, bson.M{"$set": bson.M{"owner": project.Owner}}},
+		{"nested struct json", testMask("owner"), project, JSONNaming, bson.M{"$set": bson.M{"owner": bson.D{{Key: "user_id", Value: "u1"}}}}},
+		{"full mask", testMask(), project, BSONNaming, bson.M{
+			"$set":   bson.M{"name": "demo", "owner": project.Owner},
+			"$unset": bson.M{"count": "", "labels": ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MongoUpdate(test.mask, test.src, test.naming)
+			if err != nil {
+				t.Fatalf("MongoUpdate(%v) failed: %v", test.mask.GetPaths(), err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("MongoUpdate(%v) = %#v, want %#v", test.mask.GetPaths(), got, test.want)
+			}
+		})
+	}
+}
+
+func TestFieldMaskErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		mask *field_mask.FieldMask
+	}{
+		{"unknown", testMask("missing")},
+		{"unknown nested", testMask("owner.missing")},
+		{"not stored", testMask("secret")},
+		{"operator", testMask("$where")},
+		{"empty segment", testMask("owner..email")},
+		{"value sub field", testMask("name.first")},
+		{"overlapping", testMask("owner", "owner.user_id")},
+		{"overlapping reversed", testMask("owner.user_id", "owner")},
+		{"overlapping map", testMask("labels.env", "labels")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := MongoProjection(test.mask, testMaskProject{}, BSONNaming); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("MongoProjection(%v) = %v, want an InvalidArgument error", test.mask.GetPaths(), err)
+			}
+			if _, err := MongoUpdate(test.mask, testMaskProject{}, BSONNaming); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("MongoUpdate(%v) = %v, want an InvalidArgument error", test.mask.GetPaths(), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FilterType is the type of the values a filter field is compared to
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterInt
+	FilterFloat
+	FilterBool
+	// FilterTime takes RFC 3339 timestamps or dates, e.g. "2026-01-01"
+	FilterTime
+	// FilterStringList is a list of strings, only "has" (":") applies to it
+	FilterStringList
+)
+
+// FilterField is a field which may be filtered on
+type FilterField struct {
+	// Document is the field in the Mongo documents, the filter name when empty
+	Document string
+	Type     FilterType
+}
+
+// FilterFields is the allowlist of the fields of a filter, by filter name
+type FilterFields map[string]FilterField
+
+const (
+	// MaxFilterLength is the longest filter accepted
+	MaxFilterLength = 2048
+
+	// maxFilterDepth bounds the nesting of the parentheses and NOTs
+	maxFilterDepth = 16
+)
+
+// ParseFilter compiles an AIP-160 filter, e.g. `status = "ACTIVE" AND created > "2026-01-01" OR tags:"vip"`,
+// into a Mongo query document. Only the fields of the allowlist are accepted, the values are
+// converted to the type of their field, so no operator of the user gets into the query.
+// As in AIP-160, OR binds tighter than AND and terms next to each other are ANDed.
+// An empty filter matches every document. The errors are InvalidArgument status errors.
+func ParseFilter(filter string, fields FilterFields) (bson.M, error) {
+	if len(filter) > MaxFilterLength {
+		return nil, invalidFilter("the filter is longer than %d characters", MaxFilterLength)
+	}
+	tokens, err := lexFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, fields: fields}
+	if p.done() {
+		return bson.M{}, nil
+	}
+	query, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, invalidFilter("unexpected %s", p.peek())
+	}
+	return query, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenText filterTokenKind = iota
+	tokenString
+	tokenComparator
+	tokenOpen
+	tokenClose
+	tokenMinus
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	value string
+}
+
+func (t filterToken) String() string {
+	if t.kind == tokenString {
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+func lexFilter(filter string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{kind: tokenOpen, value: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{kind: tokenClose, value: ")"})
+			i++
+		case r == '-' && (len(tokens) == 0 || tokens[len(tokens)-1].kind != tokenComparator):
+			tokens = append(tokens, filterToken{kind: tokenMinus, value: "-"})
+			i++
+		case r == '"' || r == '\'':
+			value, next, err := lexString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, value: value})
+			i = next
+		case strings.ContainsRune("=!<>:", r):
+			comparator := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' && r != '=' && r != ':' {
+				comparator += "="
+			}
+			if comparator == "!" {
+				return nil, invalidFilter("unexpected \"!\"")
+			}
+			tokens = append(tokens, filterToken{kind: tokenComparator, value: comparator})
+			i += len(comparator)
+		default:
+			start := i
+			for i < len(runes) && isFilterTextRune(runes[i]) {
+				i++
+			}
+			if start == i {
+				return nil, invalidFilter("unexpected %q", string(r))
+			}
+			tokens = append(tokens, filterToken{kind: tokenText, value: string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+func isFilterTextRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-+*", r)
+}
+
+func lexString(runes []rune, start int) (string, int, error) {
+	quote := runes[start]
+	var value []rune
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+				value = append(value, runes[i])
+			}
+		case quote:
+			return string(value), i + 1, nil
+		default:
+			value = append(value, runes[i])
+		}
+	}
+	return "", 0, invalidFilter("unterminated string")
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	fields FilterFields
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.done() {
+		return filterToken{kind: tokenText, value: "end of filter"}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) isKeyword(keyword string) bool {
+	return !p.done() && p.tokens[p.pos].kind == tokenText && p.tokens[p.pos].value == keyword
+}
+
+// parseExpression parses the sequences joined by AND, or next to each other.
+func (p *filterParser) parseExpression(depth int) (bson.M, error) {
+	if depth > maxFilterDepth {
+		return nil, invalidFilter("the filter is nested too deeply")
+	}
+	var and []interface{}
+	for {
+		factor, err := p.parseFactor(depth)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, factor)
+
+		if p.isKeyword("AND") {
+			p.pos++
+			continue
+		}
+		if p.done() || p.peek().kind == tokenClose {
+			break
+		}
+	}
+	if len(and) == 1 {
+		return and[0].(bson.M), nil
+	}
+	return bson.M{"$and": and}, nil
+}
+
+// parseFactor parses the terms joined by OR.
+func (p *filterParser) parseFactor(depth int) (bson.M, error) {
+	var or []interface{}
+	for {
+		term, err := p.parseTerm(depth)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, term)
+		if !p.isKeyword("OR") {
+			break
+		}
+		p.pos++
+	}
+	if len(or) == 1 {
+		return or[0].(bson.M), nil
+	}
+	return bson.M{"$or": or}, nil
+}
+
+// parseTerm parses a negated or plain restriction, or a parenthesized expression.
+func (p *filterParser) parseTerm(depth int) (bson.M, error) {
+	if p.isKeyword("NOT") || (!p.done() && p.peek().kind == tokenMinus) {
+		p.pos++
+		if depth+1 > maxFilterDepth {
+			return nil, invalidFilter("the filter is nested too deeply")
+		}
+		term, err := p.parseTerm(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": []interface{}{term}}, nil
+	}
+
+	if !p.done() && p.peek().kind == tokenOpen {
+		p.pos++
+		expression, err := p.parseExpression(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek().kind != tokenClose {
+			return nil, invalidFilter("missing \")\"")
+		}
+		p.pos++
+		return expression, nil
+	}
+	return p.parseRestriction()
+}
+
+// parseRestriction parses a "field comparator value" restriction.
+func (p *filterParser) parseRestriction() (bson.M, error) {
+	name := p.peek()
+	if name.kind != tokenText || name.value == "AND" || name.value == "OR" || name.value == "NOT" {
+		return nil, invalidFilter("expected a field, got %s", name)
+	}
+	p.pos++
+	field, ok := p.fields[name.value]
+	if !ok {
+		return nil, invalidFilter("unknown field %q", name.value)
+	}
+	document := field.Document
+	if document == "" {
+		document = name.value
+	}
+
+	comparator := p.peek()
+	if comparator.kind != tokenComparator {
+		return nil, invalidFilter("expected a comparator after %q", name.value)
+	}
+	p.pos++
+	arg := p.peek()
+	if p.done() || (arg.kind != tokenText && arg.kind != tokenString) {
+		return nil, invalidFilter("expected a value after %s %s", name.value, comparator.value)
+	}
+	p.pos++
+
+	if comparator.value == ":" && arg.kind == tokenText && arg.value == "*" {
+		return bson.M{document: bson.M{"$exists": true}}, nil
+	}
+	if field.Type == FilterStringList {
+		if comparator.value != ":" {
+			return nil, invalidFilter("field %q only takes \":\"", name.value)
+		}
+		return bson.M{document: arg.value}, nil
+	}
+
+	value, err := filterValue(name.value, field.Type, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch comparator.value {
+	case "=", ":":
+		if prefix, ok := value.(string); ok && arg.kind == tokenString && strings.HasSuffix(prefix, "*") {
+			// trailing wildcard, the rest of the value is matched literally
+			return bson.M{document: bson.M{"$regex": "^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, "*"))}}, nil
+		}
+		return bson.M{document: value}, nil
+	case "!=":
+		return bson.M{document: bson.M{"$ne": value}}, nil
+	case "<":
+		return bson.M{document: bson.M{"$lt": value}}, nil
+	case "<=":
+		return bson.M{document: bson.M{"$lte": value}}, nil
+	case ">":
+		return bson.M{document: bson.M{"$gt": value}}, nil
+	case ">=":
+		return bson.M{document: bson.M{"$gte": value}}, nil
+	}
+	return nil, invalidFilter("unknown comparator %q", comparator.value)
+}
+
+// filterValue converts the value to the type of the field.
+func filterValue(name string, fieldType FilterType, arg filterToken) (interface{}, error) {
+	switch fieldType {
+	case FilterString:
+		return arg.value, nil
+	case FilterInt:
+		if value, err := strconv.ParseInt(arg.value, 10, 64); err == nil {
+			return value, nil
+		}
+	case FilterFloat:
+		if value, err := strconv.ParseFloat(arg.value, 64); err == nil {
+			return value, nil
+		}
+	case FilterBool:
+		if value, err := strconv.ParseBool(arg.value); err == nil {
+			return value, nil
+		}
+	case FilterTime:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if value, err := time.Parse(layout, arg.value); err == nil {
+				return value, nil
+			}
+		}
+	}
+	return nil, invalidFilter("invalid value %s for field %q", arg, name)
+}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, "invalid filter: "+format, args...)
+}
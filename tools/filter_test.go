@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testFilterFields = FilterFields{
+	"status":  {Type: FilterString},
+	"name":    {Document: "display_name", Type: FilterString},
+	"count":   {Type: FilterInt},
+	"score":   {Type: FilterFloat},
+	"active":  {Type: FilterBool},
+	"created": {Document: "created_at", Type: FilterTime},
+	"tags":    {Type: FilterStringList},
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   bson.M
+	}{
+		{"empty", "", bson.M{}},
+		{"string", `status = "ACTIVE"`, bson.M{"status": "ACTIVE"}},
+		{"document name", `name = "demo"`, bson.M{"display_name": "demo"}},
+		{"int", `count > 3`, bson.M{"count": bson.M{"$gt": int64(3)}}},
+		{"negative int", `count >= -2`, bson.M{"count": bson.M{"$gte": int64(-2)}}},
+		{"float", `score < 0.5`, bson.M{"score": bson.M{"$lt": 0.5}}},
+		{"bool", `active != true`, bson.M{"active": bson.M{"$ne": true}}},
+		{"date", `created <= "2026-01-01"`, bson.M{"created_at": bson.M{"$lte": time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}}},
+		{"list", `tags:"vip"`, bson.M{"tags": "vip"}},
+		{"exists", `name:*`, bson.M{"display_name": bson.M{"$exists": true}}},
+		{"operator value", `status = "$ne"`, bson.M{"status": "$ne"}},
+		{"operator document", `status = "{\"$gt\": \"\"}"`, bson.M{"status": `{"$gt": ""}`}},
+		{"wildcard", `name = "a.b*"`, bson.M{"display_name": bson.M{"$regex": `^a\.b`}}},
+		{"wildcard regex", `name = "(a|b)+*"`, bson.M{"display_name": bson.M{"$regex": `^\(a\|b\)\+`}}},
+		{"unquoted wildcard", `name = a*`, bson.M{"display_name": "a*"}},
+		{"and", `status = "A" AND count = 1`, bson.M{"$and": []interface{}{bson.M{"status": "A"}, bson.M{"count": int64(1)}}}},
+		{"implicit and", `status = "A" count = 1`, bson.M{"$and": []interface{}{bson.M{"status": "A"}, bson.M{"count": int64(1)}}}},
+		{"or", `status = "A" OR status = "B"`, bson.M{"$or": []interface{}{bson.M{"status": "A"}, bson.M{"status": "B"}}}},
+		{"or binds tighter", `count = 1 AND status = "A" OR status = "B"`, bson.M{"$and": []interface{}{
+			bson.M{"count": int64(1)},
+			bson.M{"$or": []interface{}{bson.M{"status": "A"}, bson.M{"status": "B"}}},
+		}}},
+		{"not", `NOT active = true`, bson.M{"$nor": []interface{}{bson.M{"active": true}}}},
+		{"minus", `-(status = "A")`, bson.M{"$nor": []interface{}{bson.M{"status": "A"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseFilter(test.filter, testFilterFields)
+			if err != nil {
+				t.Fatalf("ParseFilter(%q) failed: %v", test.filter, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseFilter(%q) = %#v, want %#v", test.filter, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"unknown field", `secret = "x"`},
+		{"operator field", `$where = "1"`},
+		{"document field", `display_name = "x"`},
+		{"invalid int", `count = abc`},
+		{"invalid float", `score = "1e"`},
+		{"invalid bool", `active = yes`},
+		{"invalid time", `created > "yesterday"`},
+		{"list comparator", `tags = "vip"`},
+		{"missing value", `status =`},
+		{"missing comparator", `status "A"`},
+		{"unterminated string", `status = "A`},
+		{"missing parenthesis", `(status = "A"`},
+		{"extra parenthesis", `status = "A")`},
+		{"unexpected character", `status = "A" ; count = 1`},
+		{"too long", `status = "` + strings.Repeat("a", MaxFilterLength) + `"`},
+		{"nested too deeply", strings.Repeat("(", maxFilterDepth+1) + `status = "A"` + strings.Repeat(")", maxFilterDepth+1)},
+		{"negated too deeply", strings.Repeat("NOT ", maxFilterDepth+1) + `status = "A"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseFilter(test.filter, testFilterFields)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("ParseFilter(%q) = %v, %v, want an InvalidArgument error", test.filter, got, err)
+			}
+		})
+	}
+}